@@ -1,9 +1,23 @@
 package main
 
+import (
+	"mall/handler"
+	"mall/storage"
+)
+
 type Config struct {
-	Jwt  Jwt   `yaml:"jwt"`
-	Mini WxApp `yaml:"mini"`
-	Open WxApp `yaml:"open"`
+	Jwt   Jwt                      `yaml:"jwt"`
+	Mini  WxApp                    `yaml:"mini"`
+	Open  OpenApp                  `yaml:"open"`
+	Image storage.ImageStoreConfig `yaml:"image"`
+	Limit handler.Limits           `yaml:"limit"`
+	// Admins 平台管理员的 openid, 启动时授予
+	Admins []string `yaml:"admins"`
+	// TrustedProxies 可信的反向代理地址, 只有来自这些地址的 X-Forwarded-For 才用于取客户端 IP,
+	// 默认不信任任何代理
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Debug 本地开发用, 开启后才允许 open.fake 等测试功能
+	Debug bool `yaml:"debug"`
 }
 
 type WxApp struct {
@@ -11,6 +25,14 @@ type WxApp struct {
 	Secret string `yaml:"secret"`
 }
 
+// OpenApp 开放平台网站应用, 用于网页扫码登录
+type OpenApp struct {
+	AppID    string `yaml:"appid"`
+	Secret   string `yaml:"secret"`
+	Redirect string `yaml:"redirect"` // 扫码后跳转的页面, 页面把 code 和 state 提交给登录接口
+	Fake     bool   `yaml:"fake"`     // 本地测试用, 不请求微信, code 即为 UnionID, 需要同时开启 debug
+}
+
 type Jwt struct {
 	Secret string `yaml:"secret"`
 }
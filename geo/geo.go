@@ -0,0 +1,53 @@
+package geo
+
+import "math"
+
+const earthRadius = 6371000 // 米
+
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Distance 两点间球面距离(米), haversine 公式
+func Distance(a, b Point) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// InPolygon 射线法判断点是否在多边形内, 区县范围内按平面近似
+func InPolygon(p Point, polygon []Point) bool {
+	if len(polygon) < 3 {
+		return false
+	}
+	var in bool
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+// Centroid 多边形顶点的平均值, 用于排序时的距离估算
+func Centroid(polygon []Point) Point {
+	var c Point
+	if len(polygon) == 0 {
+		return c
+	}
+	for _, p := range polygon {
+		c.Lat += p.Lat
+		c.Lng += p.Lng
+	}
+	c.Lat /= float64(len(polygon))
+	c.Lng /= float64(len(polygon))
+	return c
+}
@@ -2,7 +2,10 @@ package handler
 
 import (
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/gin-gonic/gin"
@@ -72,3 +75,25 @@ func RespMessage(c *gin.Context, msg string) {
 	}
 	c.JSON(http.StatusOK, ack)
 }
+
+// RespCode 带业务错误码的提示, 客户端可按 code 区分失败原因
+func RespCode(c *gin.Context, code int, msg string) {
+	ack := Ack[any]{
+		Code:    code,
+		Message: msg,
+	}
+	c.JSON(http.StatusOK, ack)
+}
+
+// RespTooManyRequests 被限流时返回 429, Retry-After 为需要等待的秒数
+func RespTooManyRequests(c *gin.Context, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, Ack[any]{
+		Code:    http.StatusTooManyRequests,
+		Message: "请求太频繁, 请稍后再试",
+	})
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"mall/storage"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) GetAddresses(c *gin.Context) {
+	addresses, err := storage.Model[storage.Address]().GetAddresses(c.GetUint64("uid"))
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	sort.Sort(sort.Reverse(addresses))
+	Response(c, addresses)
+}
+
+func (h *Handler) PostAddress(c *gin.Context) {
+	var req struct {
+		Label    string            `json:"label"`
+		Contact  string            `json:"contact"`
+		Phone    string            `json:"phone"`
+		Address  string            `json:"address"`
+		Location *storage.Location `json:"location"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	id, err := storage.GenID()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var now = time.Now()
+	address := &storage.Address{
+		ID:         id,
+		UserID:     c.GetUint64("uid"),
+		Label:      req.Label,
+		Contact:    req.Contact,
+		Phone:      req.Phone,
+		Address:    req.Address,
+		Location:   req.Location,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	valid, msg := address.IsValid()
+	if !valid {
+		RespMessage(c, msg)
+		return
+	}
+	err = address.Save()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, address)
+}
+
+func (h *Handler) PutAddress(c *gin.Context) {
+	var req struct {
+		ID       uint64            `uri:"aid"`
+		Label    string            `json:"label"`
+		Contact  string            `json:"contact"`
+		Phone    string            `json:"phone"`
+		Address  string            `json:"address"`
+		Location *storage.Location `json:"location"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !req.Location.IsValid() {
+		RespMessage(c, "坐标错误")
+		return
+	}
+	address := &storage.Address{
+		Label:    req.Label,
+		Contact:  req.Contact,
+		Phone:    req.Phone,
+		Address:  req.Address,
+		Location: req.Location,
+	}
+	// 地址按用户存储, 只能修改自己的地址
+	updated, err := address.Update(c.GetUint64("uid"), req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, updated)
+}
+
+func (h *Handler) DeleteAddress(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"aid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = storage.Model[storage.Address]().Delete(c.GetUint64("uid"), req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.ID)
+}
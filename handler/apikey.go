@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"mall/set"
+	"mall/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *Handler) GetLesseeAPIKeys(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermAPIKeyManage) {
+		return
+	}
+	keys, err := storage.Model[storage.APIKey]().GetByLessee(req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	for i := range keys {
+		keys[i].KeyHash = ""
+	}
+	Response(c, keys)
+}
+
+// PostLesseeAPIKey 新建集成密钥, 明文只在这里返回一次.
+// 密钥的权限不能超过创建者自己在租户中的权限
+func (h *Handler) PostLesseeAPIKey(c *gin.Context) {
+	var req struct {
+		ID          uint64               `uri:"id"`
+		Name        string               `json:"name"`
+		Permissions []storage.Permission `json:"permissions"`
+		ExpireDays  int                  `json:"expire_days"` // 0 表示不过期
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.ExpireDays < 0 {
+		RespMessage(c, "过期时间错误")
+		return
+	}
+	if !authorize(c, req.ID, storage.PermAPIKeyManage) {
+		return
+	}
+	var k = storage.APIKey{
+		LesseeID:    req.ID,
+		Name:        req.Name,
+		Permissions: set.From(req.Permissions).ToSlice(),
+		CreatorID:   c.GetUint64("uid"),
+	}
+	if req.ExpireDays > 0 {
+		k.ExpireTime = time.Now().AddDate(0, 0, req.ExpireDays)
+	}
+	if ok, msg := k.IsValid(); !ok {
+		RespMessage(c, msg)
+		return
+	}
+	for _, p := range k.Permissions {
+		if !authorize(c, req.ID, p) {
+			return
+		}
+	}
+	key, err := storage.CreateAPIKey(&k)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d create api key:%d for lessee:%d permissions:%v", k.CreatorID, k.ID, k.LesseeID, k.Permissions)
+	k.KeyHash = ""
+	Response(c, gin.H{
+		"key":    key,
+		"apikey": k,
+	})
+}
+
+// DeleteLesseeAPIKey 撤销集成密钥
+func (h *Handler) DeleteLesseeAPIKey(c *gin.Context) {
+	var req struct {
+		ID  uint64 `uri:"id"`
+		KID uint64 `uri:"kid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermAPIKeyManage) {
+		return
+	}
+	err = storage.Model[storage.APIKey]().Delete(req.ID, req.KID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d revoke api key:%d of lessee:%d", c.GetUint64("uid"), req.KID, req.ID)
+	Response(c, req.KID)
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"fmt"
+	"mall/storage"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *Handler) PostOrderAttachment(c *gin.Context) {
+	var req struct {
+		ID     uint64                 `uri:"id"`
+		Kind   storage.AttachmentKind `form:"kind"`
+		Remark string                 `form:"remark"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.Bind(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = storage.AfterService
+	}
+	if !req.Kind.IsValid() {
+		RespMessage(c, "附件类型错误")
+		return
+	}
+
+	user, lessee, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	// 客户只能上传签字确认, 服务照片由指派师傅和有 order.service 权限的成员上传
+	if req.Kind != storage.Signature && order.Tech.ID != user.ID {
+		if !authorize(c, order.LesseeID, storage.PermOrderService) {
+			return
+		}
+	}
+
+	data, ext, err := readFormImage(c, "image")
+	if err != nil {
+		RespUploadError(c, err)
+		return
+	}
+	data, err = compressAndFit(data, 80, 1280, ext)
+	if err != nil {
+		logrus.Errorf("compress image error:%v", err)
+		RespInternalError(c, err)
+		return
+	}
+
+	id, err := storage.GenID()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	attachment := &storage.OrderAttachment{
+		ID:       id,
+		LesseeID: order.LesseeID,
+		OrderID:  order.ID,
+		Kind:     req.Kind,
+		User: storage.SimpleUser{
+			ID:       user.ID,
+			Nickname: user.Nickname,
+		},
+		Remark:     req.Remark,
+		Path:       fmt.Sprintf("/api/v1/mini/order/%d/attachment/%d", order.ID, id),
+		CreateTime: time.Now(),
+	}
+	attachment.Image, err = saveBlob(lessee, data)
+	if err != nil {
+		RespUploadError(c, err)
+		return
+	}
+	err = attachment.Save()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	err = storage.Model[storage.Order]().Touch(order.LesseeID, order.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	attachment.Image = ""
+	Response(c, attachment)
+}
+
+func (h *Handler) GetOrderAttachments(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	_, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	attachments, err := storage.Model[storage.OrderAttachment]().GetAttachments(order.LesseeID, order.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	sort.Sort(attachments)
+	// 不返回 blob 地址, 图片只通过需要鉴权的附件路由访问
+	for i := range attachments {
+		attachments[i].Image = ""
+	}
+	Response(c, attachments)
+}
+
+// GetOrderAttachmentImage 附件图片需要鉴权, 不走公开的 /img 路由
+func (h *Handler) GetOrderAttachmentImage(c *gin.Context) {
+	var req struct {
+		ID  uint64 `uri:"id"`
+		AID uint64 `uri:"aid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	_, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	attachment, err := storage.Model[storage.OrderAttachment]().GetByID(order.LesseeID, order.ID, req.AID)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		c.Abort()
+		return
+	}
+	data, meta, err := storage.GetImageWithMeta(attachment.Image)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		c.Abort()
+		return
+	}
+	// 附件不会被覆盖, 只是需要鉴权, 只允许客户端缓存.
+	// ETag 不用内容 hash, 避免泄露 blob 地址
+	serveImage(c, data, meta, fmt.Sprintf("attachment-%d", attachment.ID), true, true)
+}
+
+func (h *Handler) DeleteOrderAttachment(c *gin.Context) {
+	var req struct {
+		ID  uint64 `uri:"id"`
+		AID uint64 `uri:"aid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	user, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	attachment, err := storage.Model[storage.OrderAttachment]().GetByID(order.LesseeID, order.ID, req.AID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if attachment.User.ID != user.ID && !authorize(c, order.LesseeID, storage.PermOrderService) {
+		return
+	}
+	err = storage.Model[storage.OrderAttachment]().Delete(order.LesseeID, order.ID, req.AID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.AID)
+}
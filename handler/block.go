@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"errors"
+	"mall/storage"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *Handler) GetLesseeBlocks(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermBlockManage) {
+		return
+	}
+	blocks, err := storage.Model[storage.Block]().GetByLessee(req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, blocks)
+}
+
+// PutLesseeBlock 加入黑名单, 已存在时更新原因和过期时间
+func (h *Handler) PutLesseeBlock(c *gin.Context) {
+	var req struct {
+		ID         uint64            `uri:"id"`
+		Kind       storage.BlockKind `json:"kind"`
+		Target     string            `json:"target"`
+		Reason     string            `json:"reason"`
+		ExpireDays int               `json:"expire_days"` // 0 表示永久
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.ExpireDays < 0 {
+		RespMessage(c, "过期时间错误")
+		return
+	}
+	if !authorize(c, req.ID, storage.PermBlockManage) {
+		return
+	}
+	var now = time.Now()
+	block := storage.Block{
+		LesseeID:   req.ID,
+		Kind:       req.Kind,
+		Target:     req.Target,
+		Reason:     req.Reason,
+		CreatorID:  c.GetUint64("uid"),
+		CreateTime: now,
+	}
+	if req.ExpireDays > 0 {
+		block.ExpireTime = now.AddDate(0, 0, req.ExpireDays)
+	}
+	if ok, msg := block.IsValid(); !ok {
+		RespMessage(c, msg)
+		return
+	}
+	if block.Kind == storage.BlockUser {
+		uid, err := strconv.ParseUint(block.Target, 10, 64)
+		if err != nil {
+			RespMessage(c, "用户错误")
+			return
+		}
+		_, err = storage.Model[storage.User]().GetByID(uid)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			RespMessage(c, "用户不存在")
+			return
+		}
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+	}
+	err = block.Save()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d block %s:%s in lessee:%d reason:%s", block.CreatorID, block.Kind, block.Target, block.LesseeID, block.Reason)
+	Response(c, block)
+}
+
+func (h *Handler) DeleteLesseeBlock(c *gin.Context) {
+	var req struct {
+		ID     uint64            `uri:"id"`
+		Kind   storage.BlockKind `uri:"kind"`
+		Target string            `uri:"target"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermBlockManage) {
+		return
+	}
+	err = storage.Model[storage.Block]().Delete(req.ID, req.Kind, req.Target)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d unblock %s:%s in lessee:%d", c.GetUint64("uid"), req.Kind, req.Target, req.ID)
+	Response(c, req.Target)
+}
+
+// SuspendUser 平台停用账号, 不能停用平台管理员
+func (h *Handler) SuspendUser(c *gin.Context) {
+	var req struct {
+		ID         uint64 `uri:"id"`
+		Reason     string `json:"reason"`
+		ExpireDays int    `json:"expire_days"` // 0 表示永久
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.Reason == "" {
+		RespMessage(c, "请填写原因")
+		return
+	}
+	if req.ExpireDays < 0 {
+		RespMessage(c, "过期时间错误")
+		return
+	}
+	user, err := storage.Model[storage.User]().GetByID(req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if user.Kind == storage.Admin {
+		RespMessage(c, "不能停用平台管理员")
+		return
+	}
+	var now = time.Now()
+	s := &storage.Suspension{
+		Reason:     req.Reason,
+		CreatorID:  c.GetUint64("uid"),
+		CreateTime: now,
+	}
+	if req.ExpireDays > 0 {
+		s.ExpireTime = now.AddDate(0, 0, req.ExpireDays)
+	}
+	err = storage.Model[storage.User]().Suspend(req.ID, s)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d suspend user:%d reason:%s", s.CreatorID, req.ID, s.Reason)
+	Response(c, s)
+}
+
+func (h *Handler) ResumeUser(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = storage.Model[storage.User]().Suspend(req.ID, nil)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d resume user:%d", c.GetUint64("uid"), req.ID)
+	Response(c, req.ID)
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mall/set"
+	"mall/storage"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+const maxCatalogSize = 5 << 20
+
+// 导入导出的列, 第一行为表头, 列顺序可以调整
+var catalogColumns = []string{"code", "name", "price", "final_price", "status", "tags", "categories", "avatar", "description"}
+
+type CatalogError struct {
+	Row  int    `json:"row"` // 表格中的行号, 表头为第 1 行
+	Code string `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type CatalogImportAck struct {
+	DryRun  bool           `json:"dry_run"`
+	Total   int            `json:"total"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Errors  []CatalogError `json:"errors"`
+}
+
+type catalogRow struct {
+	row    int
+	goods  storage.Goods // 表格中的字段
+	merged storage.Goods // 合并到已有商品后的结果, 用于校验
+	exists bool
+	// 表格有 description 列时为该列的值, 空值清空描述; 没有该列时为 nil, 保留原描述
+	description *string
+}
+
+// readCatalog 读取上传的 csv 或 xlsx, 按表头返回每一行
+func readCatalog(c *gin.Context) ([]map[string]string, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCatalogSize)
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]string
+	// xlsx 是 zip 格式
+	if bytes.HasPrefix(data, []byte("PK")) || strings.ToLower(path.Ext(fh.Filename)) == ".xlsx" {
+		xf, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer xf.Close()
+		records, err = xf.GetRows(xf.GetSheetName(0))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		r.FieldsPerRecord = -1
+		records, err = r.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty catalog")
+	}
+
+	header := records[0]
+	known := set.From(catalogColumns)
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+		if !known.Has(header[i]) {
+			return nil, fmt.Errorf("unknown column:%s", header[i])
+		}
+	}
+	var rows = make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		// 行尾的空单元格在 xlsx 中可能不返回, 先按表头补齐
+		row := make(map[string]string, len(header))
+		for _, h := range header {
+			row[h] = ""
+		}
+		for i, v := range record {
+			if i < len(header) {
+				row[header[i]] = strings.TrimSpace(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseCatalogRow(lid uint64, v map[string]string) (storage.Goods, string) {
+	goods := storage.Goods{
+		LesseeID:    lid,
+		Code:        v["code"],
+		Name:        v["name"],
+		Status:      storage.GoodsStatus(v["status"]),
+		Tags:        GetTags(v["tags"]),
+		Avatar:      v["avatar"],
+		Description: v["description"],
+	}
+	if goods.Code == "" {
+		return goods, "商品编码为空"
+	}
+	var err error
+	if s := v["price"]; s != "" {
+		goods.Price, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return goods, "原价格式错误"
+		}
+	}
+	if s := v["final_price"]; s != "" {
+		goods.FinalPrice, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return goods, "价格格式错误"
+		}
+	}
+	if goods.Status != "" && goods.Status != storage.Active && goods.Status != storage.InActive {
+		return goods, "状态错误"
+	}
+	for _, s := range GetTags(v["categories"]) {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return goods, "分类格式错误"
+		}
+		goods.Categories = append(goods.Categories, id)
+	}
+	return goods, ""
+}
+
+// mergeCatalogRow 与 Goods.Update 的规则一致, 空字段保留原值, 描述按 description 处理
+func mergeCatalogRow(old, g storage.Goods, description *string) storage.Goods {
+	if g.Name != "" {
+		old.Name = g.Name
+	}
+	if g.Price != 0 {
+		old.Price = g.Price
+	}
+	if g.FinalPrice != 0 {
+		old.FinalPrice = g.FinalPrice
+	}
+	if g.Status != "" {
+		old.Status = g.Status
+	}
+	if len(g.Tags) > 0 {
+		old.Tags = g.Tags
+	}
+	if g.Categories != nil {
+		old.Categories = g.Categories
+	}
+	if g.Avatar != "" {
+		old.Avatar = g.Avatar
+	}
+	if description != nil {
+		old.Description = *description
+	}
+	old.SyncSkuPrice()
+	return old
+}
+
+// ImportGoods 按商品编码新建或更新商品, dry_run 时只校验不保存; 有任何一行出错时整体不导入
+func (h *Handler) ImportGoods(c *gin.Context) {
+	var req struct {
+		DryRun bool `form:"dry_run"`
+	}
+	err := c.BindQuery(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lid := c.GetUint64("lid")
+	records, err := readCatalog(c)
+	if err != nil {
+		RespMessage(c, "文件格式错误")
+		return
+	}
+	goods, err := storage.Model[storage.Goods]().GetGoods(lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var byCode = make(map[string]storage.Goods, len(goods))
+	for _, v := range goods {
+		if v.Code != "" {
+			byCode[v.Code] = v
+		}
+	}
+	categories, err := storage.Model[storage.Category]().GetCategories(lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var categoryIDs = set.New[uint64](len(categories))
+	for _, v := range categories {
+		categoryIDs.Add(v.ID)
+	}
+
+	var ack = CatalogImportAck{
+		DryRun: req.DryRun,
+		Total:  len(records),
+		Errors: make([]CatalogError, 0),
+	}
+	var rows = make([]catalogRow, 0, len(records))
+	var seen = set.New[string](len(records))
+	for i, v := range records {
+		row := catalogRow{row: i + 2}
+		var msg string
+		row.goods, msg = parseCatalogRow(lid, v)
+		if d, ok := v["description"]; ok {
+			row.description = &d
+		}
+		if msg == "" && seen.Has(row.goods.Code) {
+			msg = "商品编码重复"
+		}
+		seen.Add(row.goods.Code)
+		if msg == "" {
+			for _, id := range row.goods.Categories {
+				if !categoryIDs.Has(id) {
+					msg = "分类不存在"
+				}
+			}
+		}
+		if msg == "" {
+			var old storage.Goods
+			old, row.exists = byCode[row.goods.Code]
+			if row.exists {
+				row.merged = mergeCatalogRow(old, row.goods, row.description)
+			} else {
+				row.merged = row.goods
+				row.merged.ID, err = storage.GenID()
+				if err != nil {
+					RespInternalError(c, err)
+					return
+				}
+				if row.merged.Status == "" {
+					row.merged.Status = storage.Active
+				}
+			}
+			_, msg = row.merged.IsValid()
+		}
+		if msg != "" {
+			ack.Errors = append(ack.Errors, CatalogError{Row: row.row, Code: row.goods.Code, Msg: msg})
+			continue
+		}
+		if row.exists {
+			ack.Updated++
+		} else {
+			ack.Created++
+		}
+		rows = append(rows, row)
+	}
+	if req.DryRun || len(ack.Errors) > 0 {
+		Response(c, ack)
+		return
+	}
+
+	var now = time.Now()
+	for _, row := range rows {
+		if row.exists {
+			g := row.goods
+			g.Status = row.merged.Status
+			err = g.Update(lid, row.merged.ID, row.description)
+		} else {
+			g := row.merged
+			g.CreateTime = now
+			g.UpdateTime = now
+			err = g.Save()
+		}
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+	}
+	Response(c, ack)
+}
+
+// ExportGoods 导出当前租户的商品, 格式与导入一致
+func (h *Handler) ExportGoods(c *gin.Context) {
+	var req struct {
+		Format string `form:"format"`
+	}
+	err := c.BindQuery(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "csv"
+	}
+	if req.Format != "csv" && req.Format != "xlsx" {
+		RespMessage(c, "导出格式错误")
+		return
+	}
+	goods, err := storage.Model[storage.Goods]().GetGoods(c.GetUint64("lid"))
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	goods.SortBy(storage.SortByManual)
+
+	var records = [][]string{catalogColumns}
+	for _, g := range goods {
+		var categories = make([]string, 0, len(g.Categories))
+		for _, id := range g.Categories {
+			categories = append(categories, strconv.FormatUint(id, 10))
+		}
+		records = append(records, []string{
+			g.Code,
+			g.Name,
+			strconv.FormatFloat(g.Price, 'f', -1, 64),
+			strconv.FormatFloat(g.FinalPrice, 'f', -1, 64),
+			string(g.Status),
+			strings.Join(g.Tags, ","),
+			strings.Join(categories, ","),
+			g.Avatar,
+			g.Description,
+		})
+	}
+
+	var buf bytes.Buffer
+	var contentType string
+	if req.Format == "xlsx" {
+		xf := excelize.NewFile()
+		defer xf.Close()
+		sheet := xf.GetSheetName(0)
+		for i, record := range records {
+			cell, _ := excelize.CoordinatesToCellName(1, i+1)
+			err = xf.SetSheetRow(sheet, cell, &record)
+			if err != nil {
+				RespInternalError(c, err)
+				return
+			}
+		}
+		err = xf.Write(&buf)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	} else {
+		// 带 BOM, Excel 打开时不会乱码
+		buf.WriteString("\xef\xbb\xbf")
+		w := csv.NewWriter(&buf)
+		err = w.WriteAll(records)
+		contentType = "text/csv; charset=utf-8"
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="goods.%s"`, req.Format))
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
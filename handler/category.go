@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"mall/set"
+	"mall/storage"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CategoryNode struct {
+	storage.Category
+	Children []*CategoryNode `json:"children"`
+}
+
+func buildCategoryTree(categories storage.CategorySlice) []*CategoryNode {
+	sort.Sort(categories)
+	nodes := make(map[uint64]*CategoryNode, len(categories))
+	for _, v := range categories {
+		nodes[v.ID] = &CategoryNode{Category: v, Children: []*CategoryNode{}}
+	}
+	var roots = make([]*CategoryNode, 0)
+	for _, v := range categories {
+		parent, ok := nodes[v.ParentID]
+		if !ok {
+			// 上级不存在时作为顶级分类展示
+			roots = append(roots, nodes[v.ID])
+			continue
+		}
+		parent.Children = append(parent.Children, nodes[v.ID])
+	}
+	return roots
+}
+
+// checkCategories 校验分类都属于该租户
+func checkCategories(lid uint64, ids []uint64) (bool, error) {
+	if len(ids) == 0 {
+		return true, nil
+	}
+	categories, err := storage.Model[storage.Category]().GetCategories(lid)
+	if err != nil {
+		return false, err
+	}
+	exists := set.New[uint64](len(categories))
+	for _, v := range categories {
+		exists.Add(v.ID)
+	}
+	for _, id := range ids {
+		if !exists.Has(id) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (h *Handler) GetCategories(c *gin.Context) {
+	lid := c.GetUint64("lid")
+	if lid == 0 {
+		RespMessage(c, "非法租户")
+		return
+	}
+	categories, err := storage.Model[storage.Category]().GetCategories(lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, buildCategoryTree(categories))
+}
+
+func (h *Handler) PostCategory(c *gin.Context) {
+	var req struct {
+		ParentID uint64 `json:"parent_id"`
+		Name     string `json:"name"`
+		Icon     string `json:"icon"`
+		Sort     int    `json:"sort"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lid := c.GetUint64("lid")
+	if req.ParentID != 0 {
+		_, err := storage.Model[storage.Category]().GetByID(lid, req.ParentID)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+	}
+	id, err := storage.GenID()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var now = time.Now()
+	category := &storage.Category{
+		ID:         id,
+		LesseeID:   lid,
+		ParentID:   req.ParentID,
+		Name:       req.Name,
+		Icon:       req.Icon,
+		Sort:       req.Sort,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	valid, msg := category.IsValid()
+	if !valid {
+		RespMessage(c, msg)
+		return
+	}
+	err = category.Save()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, category)
+}
+
+func (h *Handler) PutCategory(c *gin.Context) {
+	var req struct {
+		ID       uint64  `uri:"id"`
+		ParentID *uint64 `json:"parent_id"`
+		Name     string  `json:"name"`
+		Icon     string  `json:"icon"`
+		Sort     *int    `json:"sort"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lid := c.GetUint64("lid")
+	categories, err := storage.Model[storage.Category]().GetCategories(lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var old *storage.Category
+	exists := set.New[uint64](len(categories))
+	for i := range categories {
+		exists.Add(categories[i].ID)
+		if categories[i].ID == req.ID {
+			old = &categories[i]
+		}
+	}
+	if old == nil {
+		RespMessage(c, "分类不存在")
+		return
+	}
+	category := &storage.Category{
+		Name:     req.Name,
+		Icon:     req.Icon,
+		ParentID: old.ParentID,
+		Sort:     old.Sort,
+	}
+	if req.Sort != nil {
+		category.Sort = *req.Sort
+	}
+	if req.ParentID != nil && *req.ParentID != old.ParentID {
+		parent := *req.ParentID
+		// 不能挂到自己或自己的子孙下面
+		if categories.Descendants(req.ID).Has(parent) {
+			RespMessage(c, "上级分类错误")
+			return
+		}
+		if parent != 0 && !exists.Has(parent) {
+			RespMessage(c, "上级分类不存在")
+			return
+		}
+		category.ParentID = parent
+	}
+	updated, err := category.Update(lid, req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, updated)
+}
+
+func (h *Handler) DeleteCategory(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lid := c.GetUint64("lid")
+	categories, err := storage.Model[storage.Category]().GetCategories(lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	for _, v := range categories {
+		if v.ParentID == req.ID {
+			RespMessage(c, "请先删除子分类")
+			return
+		}
+	}
+	err = storage.Model[storage.Category]().Delete(lid, req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.ID)
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"mall/storage"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *Handler) GetOrderComments(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	user, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	comments, err := storage.Model[storage.OrderComment]().GetComments(order.LesseeID, order.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	sort.Sort(comments)
+
+	if c.Request.Method == http.MethodHead {
+		var up time.Time
+		if len(comments) > 0 {
+			up = comments[len(comments)-1].CreateTime
+		}
+		c.Status(http.StatusNoContent)
+		c.Writer.Header().Set("x-up", storage.MarshalTime(up))
+		return
+	}
+
+	err = storage.Model[storage.OrderComment]().ClearUnread(user.ID, order.LesseeID, order.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, comments)
+}
+
+func (h *Handler) PostOrderComment(c *gin.Context) {
+	var req struct {
+		ID      uint64   `uri:"id"`
+		Content string   `json:"content"`
+		Images  []string `json:"images"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	user, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	// 只能引用本租户上传过的图片
+	for _, img := range req.Images {
+		ok, err := storage.IsLesseeImage(order.LesseeID, img)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		if !ok {
+			RespMessage(c, "图片不存在")
+			return
+		}
+	}
+	id, err := storage.GenID()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	comment := &storage.OrderComment{
+		ID:       id,
+		LesseeID: order.LesseeID,
+		OrderID:  order.ID,
+		User: storage.SimpleUser{
+			ID:       user.ID,
+			Nickname: user.Nickname,
+		},
+		Content:    strings.TrimSpace(req.Content),
+		Images:     req.Images,
+		CreateTime: time.Now(),
+	}
+	valid, msg := comment.IsValid()
+	if !valid {
+		RespMessage(c, msg)
+		return
+	}
+	readers, err := order.Readers()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	err = comment.Save(readers)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	// 刷新订单更新时间, 参与人通过订单轮询感知新留言
+	err = storage.Model[storage.Order]().Touch(order.LesseeID, order.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	go h.notifyComment(order, user.ID, readers)
+	Response(c, comment)
+}
+
+// PostOrderCommentImage 订单参与人上传评论图片, 返回的地址用于 PostOrderComment 的 images
+func (h *Handler) PostOrderCommentImage(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	_, lessee, _, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	key, ok := uploadImage(c, lessee, "image")
+	if !ok {
+		return
+	}
+	var ack struct {
+		Path     string            `json:"path"`
+		Variants map[string]string `json:"variants"`
+	}
+	ack.Path = imagePath(key, "")
+	ack.Variants = imageVariantPaths(key)
+	Response(c, ack)
+}
+
+// notifyComment 给作者以外的参与人发送订阅消息, 失败只记录日志
+func (h *Handler) notifyComment(order storage.Order, author uint64, readers []uint64) {
+	for _, uid := range readers {
+		if uid == author {
+			continue
+		}
+		user, err := storage.Model[storage.User]().GetByID(uid)
+		if err != nil {
+			logrus.Errorf("get user:%d error:%v", uid, err)
+			continue
+		}
+		err = h.SendCommentOrderMessage(user.OpenID, &order)
+		if err != nil {
+			logrus.Errorf("send comment notify to user:%d error:%v", uid, err)
+		}
+	}
+}
+
+func (h *Handler) DeleteOrderComment(c *gin.Context) {
+	var req struct {
+		ID  uint64 `uri:"id"`
+		CID uint64 `uri:"cid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	user, _, order, ok := h.loadParticipantOrder(c, req.ID)
+	if !ok {
+		return
+	}
+	comment, err := storage.Model[storage.OrderComment]().GetByID(order.LesseeID, order.ID, req.CID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if comment.User.ID != user.ID && !authorize(c, order.LesseeID, storage.PermCommentDelete) {
+		return
+	}
+	err = storage.Model[storage.OrderComment]().Delete(order.LesseeID, order.ID, req.CID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.CID)
+}
+
+func (h *Handler) GetOrderUnread(c *gin.Context) {
+	lid := c.GetUint64("lid")
+	if lid == 0 {
+		RespMessage(c, "非法租户")
+		return
+	}
+	unread, err := storage.Model[storage.OrderComment]().GetUnread(c.GetUint64("uid"), lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, unread)
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"mall/set"
+	"mall/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const maxGalleryImages = 9
+
+var errGalleryFull = errors.New("gallery full")
+var errGalleryMismatch = errors.New("gallery mismatch")
+
+func (h *Handler) PostGoodsImage(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lid := c.GetUint64("lid")
+	goods, err := storage.Model[storage.Goods]().GetByID(lid, req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if len(goods.Images) >= maxGalleryImages {
+		RespMessage(c, fmt.Sprintf("图集最多%d张", maxGalleryImages))
+		return
+	}
+
+	lessee, err := getLessee(c, lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	data, ext, err := readFormImage(c, "image")
+	if err != nil {
+		RespUploadError(c, err)
+		return
+	}
+	data, err = compressAndFit(data, 85, maxImageSize, ext)
+	if err != nil {
+		logrus.Errorf("compress image error:%v", err)
+		RespInternalError(c, err)
+		return
+	}
+	key, err := saveBlob(lessee, data)
+	if err != nil {
+		RespUploadError(c, err)
+		return
+	}
+	path := imagePath(key, "")
+	images, err := storage.Model[storage.Goods]().UpdateImages(lid, goods.ID, func(images []string) ([]string, error) {
+		if len(images) >= maxGalleryImages {
+			return nil, errGalleryFull
+		}
+		return append(images, path), nil
+	})
+	// 保存失败时图片没有引用, 由 GC 回收
+	if errors.Is(err, errGalleryFull) {
+		RespMessage(c, fmt.Sprintf("图集最多%d张", maxGalleryImages))
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, images)
+}
+
+// PutGoodsImages 调整图集顺序, 需提交当前图集的全部图片
+func (h *Handler) PutGoodsImages(c *gin.Context) {
+	var req struct {
+		ID     uint64   `uri:"id"`
+		Images []string `json:"images"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	images, err := storage.Model[storage.Goods]().UpdateImages(c.GetUint64("lid"), req.ID, func(images []string) ([]string, error) {
+		if len(images) != len(req.Images) {
+			return nil, errGalleryMismatch
+		}
+		current := set.From(images)
+		seen := set.New[string](len(images))
+		for _, v := range req.Images {
+			if !current.Has(v) || seen.Has(v) {
+				return nil, errGalleryMismatch
+			}
+			seen.Add(v)
+		}
+		return req.Images, nil
+	})
+	if errors.Is(err, errGalleryMismatch) {
+		RespMessage(c, "图集已变化, 请刷新后重试")
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, images)
+}
+
+// DeleteGoodsImage 从图集移除图片, hash 为图片地址中的内容 hash
+func (h *Handler) DeleteGoodsImage(c *gin.Context) {
+	var req struct {
+		ID   uint64 `uri:"id"`
+		Hash string `uri:"hash"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	images, err := storage.Model[storage.Goods]().UpdateImages(c.GetUint64("lid"), req.ID, func(images []string) ([]string, error) {
+		var remain = make([]string, 0, len(images))
+		for _, v := range images {
+			if hash, _ := storage.ImageHashFromPath(v); hash != req.Hash {
+				remain = append(remain, v)
+			}
+		}
+		return remain, nil
+	})
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, images)
+}
@@ -1,26 +1,33 @@
 package handler
 
 import (
+	"errors"
+	"mall/set"
 	"mall/storage"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/gin-gonic/gin"
 )
 
 func (h *Handler) PostGoods(c *gin.Context) {
 	var req struct {
-		ID         uint64              `json:"id"`
-		LesseeID   uint64              `json:"lessee_id"`
-		Status     storage.GoodsStatus `json:"status"`
-		Name       string              `json:"name"`
-		Price      float64             `json:"price"`
-		FinalPrice float64             `json:"final_price"`
-		Tags       []string            `json:"tags"`
-		Avatar     string              `json:"avatar"`
+		ID          uint64                `json:"id"`
+		LesseeID    uint64                `json:"lessee_id"`
+		Code        string                `json:"code"`
+		Status      storage.GoodsStatus   `json:"status"`
+		Name        string                `json:"name"`
+		Price       float64               `json:"price"`
+		FinalPrice  float64               `json:"final_price"`
+		Tags        []string              `json:"tags"`
+		Categories  []uint64              `json:"categories"`
+		Options     []storage.GoodsOption `json:"options"`
+		Skus        []storage.Sku         `json:"skus"`
+		Avatar      string                `json:"avatar"`
+		Description string                `json:"description"`
 	}
 	err := c.Bind(&req)
 	if err != nil {
@@ -34,25 +41,54 @@ func (h *Handler) PostGoods(c *gin.Context) {
 
 	var now = time.Now()
 	goods := storage.Goods{
-		ID:         req.ID,
-		LesseeID:   req.LesseeID,
-		Name:       req.Name,
-		Price:      req.Price,
-		FinalPrice: req.FinalPrice,
-		Status:     req.Status,
-		Tags:       req.Tags,
-		Avatar:     req.Avatar,
-		CreateTime: now,
-		UpdateTime: now,
+		ID:          req.ID,
+		LesseeID:    req.LesseeID,
+		Code:        strings.TrimSpace(req.Code),
+		Name:        req.Name,
+		Price:       req.Price,
+		FinalPrice:  req.FinalPrice,
+		Status:      req.Status,
+		Tags:        req.Tags,
+		Categories:  req.Categories,
+		Options:     req.Options,
+		Skus:        req.Skus,
+		Avatar:      req.Avatar,
+		Description: req.Description,
+		CreateTime:  now,
+		UpdateTime:  now,
 	}
 	if goods.LesseeID == 0 {
 		goods.LesseeID = c.GetUint64("lid")
 	}
+	err = assignSkuIDs(goods.Skus)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	goods.SyncSkuPrice()
 	ok, msg := goods.IsValid()
 	if !ok {
 		RespMessage(c, msg)
 		return
 	}
+	ok, err = checkCategories(goods.LesseeID, goods.Categories)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !ok {
+		RespMessage(c, "分类不存在")
+		return
+	}
+	ok, err = checkGoodsCode(goods.LesseeID, goods.ID, goods.Code)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !ok {
+		RespMessage(c, "商品编码已存在")
+		return
+	}
 	err = goods.Save()
 	if err != nil {
 		RespInternalError(c, err)
@@ -62,88 +98,177 @@ func (h *Handler) PostGoods(c *gin.Context) {
 }
 
 func (h *Handler) GetGoodsList(c *gin.Context) {
+	goods, ok := h.listGoods(c)
+	if !ok {
+		return
+	}
+	Response(c, goods)
+}
+
+type PreInfo struct {
+	ID         uint64    `json:"id"`
+	UpdateTime time.Time `json:"up"`
+}
+
+func (h *Handler) PreGetGoodsList(c *gin.Context) {
+	goods, ok := h.listGoods(c)
+	if !ok {
+		return
+	}
+	var infos = make([]PreInfo, 0, len(goods))
+	for _, v := range goods {
+		infos = append(infos, PreInfo{
+			ID:         v.ID,
+			UpdateTime: v.UpdateTime,
+		})
+	}
+	Response(c, infos)
+}
+
+// listGoods 商品列表和 pre 共用, 保证两者过滤排序一致
+func (h *Handler) listGoods(c *gin.Context) (storage.GoodsSlice, bool) {
 	var req struct {
-		Status storage.GoodsStatus `form:"status"`
+		Status   storage.GoodsStatus `form:"status"`
+		Category uint64              `form:"category"`
+		Sort     storage.GoodsSort   `form:"sort"`
 	}
 	err := c.Bind(&req)
 	if err != nil {
 		RespBindError(c, err)
-		return
+		return nil, false
+	}
+	if !req.Sort.IsValid() {
+		RespMessage(c, "排序方式错误")
+		return nil, false
 	}
 	if req.Status != storage.Active {
-		uid := c.GetUint64("uid")
-		user, err := storage.Model[storage.User]().GetByID(uid)
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if user.Kind != storage.Manger && user.Kind != storage.Admin {
-			RespForbidden(c)
-			return
+		if !authorize(c, c.GetUint64("lid"), storage.PermGoodsWrite) {
+			return nil, false
 		}
 	}
-	goods, err := storage.Model[storage.Goods]().GetGoods(c.GetUint64("lid"))
+	lid := c.GetUint64("lid")
+	goods, err := storage.Model[storage.Goods]().GetGoods(lid)
 	if err != nil {
 		RespInternalError(c, err)
-		return
+		return nil, false
 	}
+	var categories *set.Set[uint64]
+	if req.Category != 0 {
+		cs, err := storage.Model[storage.Category]().GetCategories(lid)
+		if err != nil {
+			RespInternalError(c, err)
+			return nil, false
+		}
+		categories = cs.Descendants(req.Category)
+	}
+	var now = time.Now()
 	var respGoods = make(storage.GoodsSlice, 0, len(goods))
 	for i := range goods {
-		if goods[i].Status == req.Status || req.Status == "" {
-			respGoods = append(respGoods, goods[i])
+		goods[i].ApplyPriceRules(now)
+		if goods[i].Status != req.Status && req.Status != "" {
+			continue
 		}
+		if categories != nil && !inCategories(goods[i].Categories, categories) {
+			continue
+		}
+		respGoods = append(respGoods, goods[i])
 	}
-	sort.Sort(sort.Reverse(respGoods))
-	Response(c, respGoods)
+	respGoods.SortBy(req.Sort)
+	return respGoods, true
 }
 
-type PreInfo struct {
-	ID         uint64    `json:"id"`
-	UpdateTime time.Time `json:"up"`
+type SearchGoodsAck struct {
+	Total int                `json:"total"`
+	Goods storage.GoodsSlice `json:"goods"`
 }
 
-func (h *Handler) PreGetGoodsList(c *gin.Context) {
+// SearchGoods 按名称、标签和描述搜索上架商品, 结果按相关度排序
+func (h *Handler) SearchGoods(c *gin.Context) {
 	var req struct {
-		Status storage.GoodsStatus `form:"status"`
-	}
-	err := c.Bind(&req)
+		Q        string  `form:"q"`
+		MinPrice float64 `form:"min_price"`
+		MaxPrice float64 `form:"max_price"`
+		Tags     string  `form:"tags"` // 逗号分隔, 需全部包含
+		Page     int     `form:"page"`
+		Size     int     `form:"size"`
+	}
+	err := c.BindQuery(&req)
 	if err != nil {
 		RespBindError(c, err)
 		return
 	}
-	if req.Status != storage.Active {
-		uid := c.GetUint64("uid")
-		user, err := storage.Model[storage.User]().GetByID(uid)
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if user.Kind != storage.Manger && user.Kind != storage.Admin {
-			RespForbidden(c)
-			return
-		}
+	if strings.TrimSpace(req.Q) == "" {
+		RespMessage(c, "请输入搜索内容")
+		return
+	}
+	if req.Page <= 0 {
+		req.Page = 1
 	}
-	goods, err := storage.Model[storage.Goods]().GetGoods(c.GetUint64("lid"))
+	if req.Size <= 0 || req.Size > 100 {
+		req.Size = 20
+	}
+	lid := c.GetUint64("lid")
+	goods, err := storage.Model[storage.Goods]().GetGoods(lid)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	var respGoods = make(storage.GoodsSlice, 0, len(goods))
-	for i := range goods {
-		if goods[i].Status == req.Status || req.Status == "" {
-			respGoods = append(respGoods, goods[i])
+	var now = time.Now()
+	var goodsMap = make(map[uint64]storage.Goods, len(goods))
+	for _, v := range goods {
+		v.ApplyPriceRules(now)
+		goodsMap[v.ID] = v
+	}
+	tags := GetTags(req.Tags)
+
+	var matched = make(storage.GoodsSlice, 0)
+	for _, r := range storage.Model[storage.Goods]().Search(lid, req.Q) {
+		g, ok := goodsMap[r.ID]
+		if !ok || g.Status != storage.Active {
+			continue
 		}
+		if req.MinPrice > 0 && g.FinalPrice < req.MinPrice {
+			continue
+		}
+		if req.MaxPrice > 0 && g.FinalPrice > req.MaxPrice {
+			continue
+		}
+		if !hasTags(g.Tags, tags) {
+			continue
+		}
+		matched = append(matched, g)
 	}
-	sort.Sort(sort.Reverse(respGoods))
-	var infos = make([]PreInfo, 0, len(respGoods))
-	for _, v := range respGoods {
-		infos = append(infos, PreInfo{
-			ID:         v.ID,
-			UpdateTime: v.UpdateTime,
-		})
+
+	var ack = SearchGoodsAck{
+		Total: len(matched),
+		Goods: storage.GoodsSlice{},
 	}
-	Response(c, infos)
+	start := (req.Page - 1) * req.Size
+	if start < len(matched) {
+		ack.Goods = matched[start:min(start+req.Size, len(matched))]
+	}
+	Response(c, ack)
+}
+
+func hasTags(goodsTags, tags []string) bool {
+	all := set.From(goodsTags)
+	for _, t := range tags {
+		if !all.Has(t) {
+			return false
+		}
+	}
+	return true
 }
+
+func inCategories(ids []uint64, categories *set.Set[uint64]) bool {
+	for _, id := range ids {
+		if categories.Has(id) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) GetGoods(c *gin.Context) {
 	var req struct {
 		ID uint64 `uri:"id"`
@@ -162,6 +287,7 @@ func (h *Handler) GetGoods(c *gin.Context) {
 		RespInternalError(c, err)
 		return
 	}
+	goods.ApplyPriceRules(time.Now())
 
 	if c.Request.Method == http.MethodHead {
 		c.Status(http.StatusNoContent)
@@ -173,12 +299,18 @@ func (h *Handler) GetGoods(c *gin.Context) {
 
 func (h *Handler) PutGoods(c *gin.Context) {
 	var req struct {
-		ID         uint64              `uri:"id"`
-		Status     storage.GoodsStatus `json:"status"`
-		Name       string              `json:"name"`
-		Price      float64             `json:"price"`
-		FinalPrice float64             `json:"final_price"`
-		Tags       []string            `json:"tags"`
+		ID          uint64                `uri:"id"`
+		Code        string                `json:"code"`
+		Status      storage.GoodsStatus   `json:"status"`
+		Name        string                `json:"name"`
+		Price       float64               `json:"price"`
+		FinalPrice  float64               `json:"final_price"`
+		Tags        []string              `json:"tags"`
+		Categories  []uint64              `json:"categories"`
+		Options     []storage.GoodsOption `json:"options"`
+		Skus        []storage.Sku         `json:"skus"`
+		Avatar      string                `json:"avatar"`
+		Description *string               `json:"description"` // 不传时不修改, 空字符串清空
 	}
 	err := c.Bind(&req)
 	if err != nil {
@@ -198,13 +330,21 @@ func (h *Handler) PutGoods(c *gin.Context) {
 	var now = time.Now()
 	goods := storage.Goods{
 		ID:         req.ID,
+		Code:       strings.TrimSpace(req.Code),
 		Name:       req.Name,
 		Status:     req.Status,
 		Price:      req.Price,
 		FinalPrice: req.FinalPrice,
 		Tags:       req.Tags,
+		Categories: req.Categories,
+		Options:    req.Options,
+		Skus:       req.Skus,
+		Avatar:     req.Avatar,
 		UpdateTime: now,
 	}
+	if req.Description != nil {
+		goods.Description = *req.Description
+	}
 	if goods.LesseeID == 0 {
 		goods.LesseeID = c.GetUint64("lid")
 	}
@@ -212,7 +352,37 @@ func (h *Handler) PutGoods(c *gin.Context) {
 		RespMessage(c, "非法租户")
 		return
 	}
-	err = goods.Update(goods.LesseeID, req.ID)
+	ok, err := checkCategories(goods.LesseeID, goods.Categories)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !ok {
+		RespMessage(c, "分类不存在")
+		return
+	}
+	ok, err = checkGoodsCode(goods.LesseeID, goods.ID, goods.Code)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !ok {
+		RespMessage(c, "商品编码已存在")
+		return
+	}
+	if goods.Skus != nil {
+		err = assignSkuIDs(goods.Skus)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		ok, msg := goods.IsSkusValid()
+		if !ok {
+			RespMessage(c, msg)
+			return
+		}
+	}
+	err = goods.Update(goods.LesseeID, req.ID, req.Description)
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -235,8 +405,81 @@ func (h *Handler) DeleteGoods(c *gin.Context) {
 		RespInternalError(c, err)
 		return
 	}
-	key := storage.GetGoodsAvatarImageKey(id)
-	storage.Delete(key)
+}
+
+// PutGoodsSort 按提交的 id 顺序设置手动排序
+func (h *Handler) PutGoodsSort(c *gin.Context) {
+	var req struct {
+		IDs []uint64 `json:"ids"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if len(req.IDs) == 0 || len(set.From(req.IDs).ToSlice()) != len(req.IDs) {
+		RespMessage(c, "商品列表错误")
+		return
+	}
+	err = storage.Model[storage.Goods]().UpdateSort(c.GetUint64("lid"), req.IDs)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.IDs)
+}
+
+func (h *Handler) PutGoodsPinned(c *gin.Context) {
+	var req struct {
+		ID     uint64 `uri:"id"`
+		Pinned bool   `json:"pinned"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = storage.Model[storage.Goods]().UpdatePinned(c.GetUint64("lid"), req.ID, req.Pinned)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.ID)
+}
+
+// checkGoodsCode 商品编码在租户内唯一, 为空时不检查
+func checkGoodsCode(lid, id uint64, code string) (bool, error) {
+	if code == "" {
+		return true, nil
+	}
+	goods, err := storage.Model[storage.Goods]().GetByCode(lid, code)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return goods.ID == id, nil
+}
+
+// assignSkuIDs 新增的规格分配 id, 已有规格保留 id 以便保留销量
+func assignSkuIDs(skus []storage.Sku) error {
+	for i := range skus {
+		if skus[i].ID != 0 {
+			continue
+		}
+		id, err := storage.GenID()
+		if err != nil {
+			return err
+		}
+		skus[i].ID = id
+	}
+	return nil
 }
 
 func GetTags(s string) []string {
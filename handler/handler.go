@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"mall/oauth"
 	"mall/storage"
 
 	"github.com/ArtisanCloud/PowerWeChat/v3/src/miniProgram"
@@ -9,10 +10,12 @@ import (
 
 type Handler struct {
 	wxApp     *miniProgram.MiniProgram
+	webOAuth  oauth.Client // 网页扫码登录
 	jwtSecret string
+	limits    Limits
 }
 
-func NewHandler(e *gin.Engine, appid, secret, jwtSecret string) *Handler {
+func NewHandler(e *gin.Engine, appid, secret, jwtSecret string, webOAuth oauth.Client, limits Limits) *Handler {
 	miniProgram, err := miniProgram.NewMiniProgram(&miniProgram.UserConfig{
 		AppID:  appid,
 		Secret: secret,
@@ -28,6 +31,8 @@ func NewHandler(e *gin.Engine, appid, secret, jwtSecret string) *Handler {
 	h := &Handler{
 		jwtSecret: jwtSecret,
 		wxApp:     miniProgram,
+		webOAuth:  webOAuth,
+		limits:    limits.withDefaults(),
 	}
 
 	h.Register(e)
@@ -39,60 +44,120 @@ func (h *Handler) Register(e *gin.Engine) {
 	e.GET("/api/health", func(c *gin.Context) {
 		c.String(200, "alive")
 	})
-	e.POST("/api/v1/login", h.Login)
+	loginLimit := RateLimit("login", h.limits.Login)
+	e.POST("/api/v1/login", loginLimit, h.Login)
+	e.POST("/api/v1/token/refresh", h.RefreshToken)
+	e.GET("/api/v1/web/login/qrcode", h.GetWebLoginURL)
+	e.POST("/api/v1/web/login", loginLimit, h.WebLogin)
 	e.GET("/img/:target/:type/:id", h.GetImage)
+	e.HEAD("/img/:target/:type/:id", h.GetImage)
 
 	e.Use(LesseeMiddle)
 
 	api := e.Group("/api/v1/mini")
+	// 租户后台系统可以用 X-Api-Key 调用的接口: 查看订单, 维护商品
+	apiKey := GetAPIKeyMiddle(h.jwtSecret)
 
-	api.POST("/image", h.PostImage)
-	api.POST("/image/:id", h.PostImage)
+	imageLimit := RateLimit("image", h.limits.Image)
+	api.POST("/image", apiKey, RequirePermission(storage.PermGoodsWrite), imageLimit, h.PostImage)
+	api.POST("/image/:id", apiKey, RequirePermission(storage.PermGoodsWrite), imageLimit, h.PostImage)
 
 	goods := api.Group("/goods")
-	goods.GET("", h.GetGoodsList)
-	goods.GET("/pre", h.PreGetGoodsList)
-	goods.GET("/manage", GetSessionMiddle(h.jwtSecret), h.GetGoodsList)
-	goods.GET("/manage/pre", GetSessionMiddle(h.jwtSecret), h.PreGetGoodsList)
-	goods.GET("/:id", h.GetGoods)
-	goods.HEAD("/:id", h.GetGoods)
-	goods.POST("", GetSessionMiddle(h.jwtSecret), h.PostGoods)
-	goods.PUT("/:id", GetSessionMiddle(h.jwtSecret), h.PutGoods)
-	goods.DELETE("/:id", GetSessionMiddle(h.jwtSecret), h.DeleteGoods)
-
-	order := api.Group("/order", GetSessionMiddle(h.jwtSecret))
-	order.GET("", h.GetOrders)
-	order.GET("/pre", h.PreGetOrders)
-	order.GET("/:id", h.GetOrder)
-	order.HEAD("/:id", h.GetOrder)
-	order.POST("", h.PostOrder)
-	order.PUT("/:id", h.PutOrder)
-	order.DELETE("/:id", RoleMiddle(storage.Admin), h.DeleteOrder)
+	goods.GET("", ActiveLesseeMiddle, h.GetGoodsList)
+	goods.GET("/pre", ActiveLesseeMiddle, h.PreGetGoodsList)
+	goods.GET("/search", ActiveLesseeMiddle, h.SearchGoods)
+	goods.GET("/manage", apiKey, h.GetGoodsList)
+	goods.GET("/manage/pre", apiKey, h.PreGetGoodsList)
+	goods.GET("/:id", ActiveLesseeMiddle, h.GetGoods)
+	goods.HEAD("/:id", ActiveLesseeMiddle, h.GetGoods)
+	goods.POST("", apiKey, RequirePermission(storage.PermGoodsWrite), h.PostGoods)
+	goods.POST("/import", apiKey, RequirePermission(storage.PermGoodsWrite), h.ImportGoods)
+	goods.GET("/export", apiKey, RequirePermission(storage.PermGoodsWrite), h.ExportGoods)
+	goods.PUT("/sort", apiKey, RequirePermission(storage.PermGoodsWrite), h.PutGoodsSort)
+	goods.PUT("/:id", apiKey, RequirePermission(storage.PermGoodsWrite), h.PutGoods)
+	goods.PUT("/:id/pinned", apiKey, RequirePermission(storage.PermGoodsWrite), h.PutGoodsPinned)
+	goods.DELETE("/:id", apiKey, RequirePermission(storage.PermGoodsWrite), h.DeleteGoods)
+	goods.POST("/:id/image", apiKey, RequirePermission(storage.PermGoodsWrite), h.PostGoodsImage)
+	goods.PUT("/:id/image", apiKey, RequirePermission(storage.PermGoodsWrite), h.PutGoodsImages)
+	goods.DELETE("/:id/image/:hash", apiKey, RequirePermission(storage.PermGoodsWrite), h.DeleteGoodsImage)
+	goods.POST("/:id/price/rule", apiKey, RequirePermission(storage.PermGoodsWrite), h.PostPriceRule)
+	goods.DELETE("/:id/price/rule/:rid", apiKey, RequirePermission(storage.PermGoodsWrite), h.DeletePriceRule)
+	goods.GET("/:id/price/history", apiKey, RequirePermission(storage.PermGoodsWrite), h.GetPriceHistory)
+
+	category := api.Group("/category")
+	category.GET("", ActiveLesseeMiddle, h.GetCategories)
+	category.POST("", GetSessionMiddle(h.jwtSecret), RequirePermission(storage.PermGoodsWrite), h.PostCategory)
+	category.PUT("/:id", GetSessionMiddle(h.jwtSecret), RequirePermission(storage.PermGoodsWrite), h.PutCategory)
+	category.DELETE("/:id", GetSessionMiddle(h.jwtSecret), RequirePermission(storage.PermGoodsWrite), h.DeleteCategory)
+
+	order := api.Group("/order")
+	order.GET("", apiKey, h.GetOrders)
+	order.GET("/pre", apiKey, h.PreGetOrders)
+	order.GET("/:id", apiKey, h.GetOrder)
+	order.HEAD("/:id", apiKey, h.GetOrder)
+	order.POST("", GetSessionMiddle(h.jwtSecret), ActiveLesseeMiddle, RateLimit("order", h.limits.Order), h.PostOrder)
+	order.PUT("/:id", GetSessionMiddle(h.jwtSecret), h.PutOrder)
+	order.DELETE("/:id", GetSessionMiddle(h.jwtSecret), RequirePermission(storage.PermPlatform), h.DeleteOrder)
+	order.GET("/unread", GetSessionMiddle(h.jwtSecret), h.GetOrderUnread)
+	order.GET("/:id/comment", GetSessionMiddle(h.jwtSecret), h.GetOrderComments)
+	order.HEAD("/:id/comment", GetSessionMiddle(h.jwtSecret), h.GetOrderComments)
+	order.POST("/:id/comment", GetSessionMiddle(h.jwtSecret), ActiveLesseeMiddle, h.PostOrderComment)
+	order.DELETE("/:id/comment/:cid", GetSessionMiddle(h.jwtSecret), h.DeleteOrderComment)
+	order.POST("/:id/comment/image", GetSessionMiddle(h.jwtSecret), ActiveLesseeMiddle, imageLimit, h.PostOrderCommentImage)
+	order.GET("/:id/attachment", GetSessionMiddle(h.jwtSecret), h.GetOrderAttachments)
+	order.POST("/:id/attachment", GetSessionMiddle(h.jwtSecret), h.PostOrderAttachment)
+	order.GET("/:id/attachment/:aid", GetSessionMiddle(h.jwtSecret), h.GetOrderAttachmentImage)
+	order.DELETE("/:id/attachment/:aid", GetSessionMiddle(h.jwtSecret), h.DeleteOrderAttachment)
 
 	user := api.Group("/user", GetSessionMiddle(h.jwtSecret))
 	user.GET("/info", h.PreLogin)
 	user.HEAD("/info", h.PreLogin)
+	user.GET("/member", h.GetUserMembers)
+	user.POST("/logout", h.Logout)
+	user.POST("/:id/revoke", h.RevokeUserTokens)
+	user.GET("/address", h.GetAddresses)
+	user.POST("/address", h.PostAddress)
+	user.PUT("/address/:aid", h.PutAddress)
+	user.DELETE("/address/:aid", h.DeleteAddress)
 	user.PUT("/:id", h.PutUser)
 	user.GET("/:id", h.GetUser)
 	user.HEAD("/:id", h.GetUser)
-	user.GET("", RoleMiddle(storage.Admin, storage.Manger), h.GetUsers)
+	user.GET("", RequirePermission(storage.PermUserRead), h.GetUsers)
 	user.DELETE("/:id", h.DeleteUser)
+	user.PUT("/:id/suspend", RequirePermission(storage.PermPlatform), h.SuspendUser)
+	user.DELETE("/:id/suspend", RequirePermission(storage.PermPlatform), h.ResumeUser)
+
+	admin := api.Group("/admin", GetSessionMiddle(h.jwtSecret), RequirePermission(storage.PermPlatform))
+	admin.GET("/audit", h.GetAdminAudits)
 
 	lessee := api.Group("/lessee", GetSessionMiddle(h.jwtSecret))
-	lessee.POST("", RoleMiddle(storage.Admin), h.PostLessee)
-	lessee.PUT("/:id", RoleMiddle(storage.Admin), h.PutLessee)
-	lessee.PUT("/:id/manager", RoleMiddle(storage.Admin, storage.Manger), h.UpdateLesseeManager)
-	lessee.PUT("/:id/tech", RoleMiddle(storage.Admin, storage.Manger), h.UpdateLesseeTech)
+	lessee.POST("", RequirePermission(storage.PermPlatform), h.PostLessee)
+	lessee.PUT("/:id", RequirePermission(storage.PermPlatform), h.PutLessee)
+	lessee.PUT("/:id/manager", h.UpdateLesseeManager)
+	lessee.PUT("/:id/tech", h.UpdateLesseeTech)
+	lessee.PUT("/:id/area", h.UpdateLesseeArea)
+	lessee.GET("/:id/usage", h.GetLesseeImageUsage)
 	lessee.GET("", h.GetLesseeList)
+	lessee.GET("/nearby", h.GetNearbyLessees)
 	lessee.GET("/:id", h.GetLessee)
-	lessee.DELETE("/:id", RoleMiddle(storage.Admin), h.DeleteLessee)
-	lessee.GET("/:id/tech", RoleMiddle(storage.Admin, storage.Manger), h.GetLesseeMembers)
-	lessee.GET("/:id/manager", RoleMiddle(storage.Admin), h.GetLesseeAdmins)
+	lessee.DELETE("/:id", RequirePermission(storage.PermPlatform), h.DeleteLessee)
+	lessee.GET("/:id/tech", h.GetLesseeMembers)
+	lessee.GET("/:id/manager", h.GetLesseeAdmins)
+	lessee.PUT("/:id/member", h.UpdateLesseeMember)
+	lessee.GET("/:id/role", h.GetLesseeRoles)
+	lessee.PUT("/:id/role/:name", h.PutLesseeRole)
+	lessee.DELETE("/:id/role/:name", h.DeleteLesseeRole)
+	lessee.GET("/:id/apikey", h.GetLesseeAPIKeys)
+	lessee.POST("/:id/apikey", h.PostLesseeAPIKey)
+	lessee.DELETE("/:id/apikey/:kid", h.DeleteLesseeAPIKey)
+	lessee.GET("/:id/block", h.GetLesseeBlocks)
+	lessee.PUT("/:id/block", h.PutLesseeBlock)
+	lessee.DELETE("/:id/block/:kind/:target", h.DeleteLesseeBlock)
 
 	join := api.Group("/join", GetSessionMiddle(h.jwtSecret))
-	join.POST("", h.PostJoin)
-	join.GET("", RoleMiddle(storage.Admin, storage.Manger), h.GetJoins)
-	join.PUT("/:id", RoleMiddle(storage.Admin, storage.Manger), h.PutJoin)
-	join.DELETE("/:id", RoleMiddle(storage.Admin, storage.Manger), h.DeleteJoin)
+	join.POST("", ActiveLesseeMiddle, RateLimit("join", h.limits.Join), h.PostJoin)
+	join.GET("", RequirePermission(storage.PermJoinDecide), h.GetJoins)
+	join.PUT("/:id", RequirePermission(storage.PermJoinDecide), h.PutJoin)
+	join.DELETE("/:id", RequirePermission(storage.PermJoinDecide), h.DeleteJoin)
 
 }
@@ -7,43 +7,202 @@ import (
 	"image"
 	"image/jpeg"
 	"image/png"
-	"io"
 	"mall/storage"
 	"net/http"
-	"path"
 	"strconv"
 	"strings"
 
+	"github.com/HugoSmits86/nativewebp"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
+// 原图最长边, 超过时等比缩小后保存
+const maxImageSize = 2048
+
+type imageVariant struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool // 居中裁剪为 Width x Height, 否则等比缩放到不超过该尺寸
+}
+
+var imageVariants = map[string]imageVariant{
+	"thumb":  {Name: "thumb", Width: 150, Height: 150, Crop: true},
+	"medium": {Name: "medium", Width: 480, Height: 480, Crop: true},
+	"large":  {Name: "large", Width: 1080, Height: 1080, Crop: true},
+	"fit":    {Name: "fit", Width: 1080, Height: 1080},
+}
+
+// 按宽度缩放时向上取到这些档位, 避免任意宽度撑爆缓存
+var imageWidths = []int{100, 150, 200, 300, 400, 480, 640, 750, 1080, 1440, maxImageSize}
+
+func parseImageVariant(name, width string) (imageVariant, bool) {
+	if name != "" {
+		v, ok := imageVariants[name]
+		return v, ok
+	}
+	if width == "" {
+		return imageVariant{}, true
+	}
+	w, err := strconv.Atoi(width)
+	if err != nil || w <= 0 {
+		return imageVariant{}, false
+	}
+	for _, v := range imageWidths {
+		if v >= w {
+			w = v
+			break
+		}
+	}
+	if w > maxImageSize {
+		w = maxImageSize
+	}
+	return imageVariant{Name: fmt.Sprintf("w%d", w), Width: w}, true
+}
+
 func (h *Handler) GetImage(c *gin.Context) {
 	key := c.Request.URL.Path
 	key = strings.TrimPrefix(key, "/")
-	var data []byte
-	err := storage.GetDB().View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+	variant, ok := parseImageVariant(c.Query("v"), c.Query("w"))
+	if !ok {
+		c.Status(http.StatusBadRequest)
+		c.Abort()
+		return
+	}
+	webp := strings.Contains(c.GetHeader("Accept"), "image/webp")
+
+	// 只被订单附件引用的图片需要鉴权, 见 GetOrderAttachmentImage
+	if hash, ok := storage.ImageHashFromPath("/" + key); ok {
+		private, err := storage.IsPrivateImage(hash)
 		if err != nil {
-			return err
+			logrus.Errorf("check image:%s refs error:%v", key, err)
+			c.Status(http.StatusInternalServerError)
+			c.Abort()
+			return
+		}
+		if private {
+			c.Status(http.StatusNotFound)
+			c.Abort()
+			return
 		}
-		data, err = item.ValueCopy(nil)
-		return err
-	})
+	}
+
+	data, meta, err := loadImage(key, variant, webp)
+	if err == nil {
+		// 按内容 hash 存储的图片内容不会变, 可长期缓存
+		immutable := strings.HasPrefix(key, storage.GetBlobKey(""))
+		c.Header("Vary", "Accept")
+		serveImage(c, data, meta, meta.Hash, immutable, false)
+		return
+	}
 	if errors.Is(err, badger.ErrKeyNotFound) {
 		c.Status(404)
 		c.Abort()
 		return
 	}
+	logrus.Errorf("load image:%s variant:%s error:%v", key, variant.Name, err)
+	c.Status(http.StatusInternalServerError)
+	c.Abort()
+}
+
+// serveImage 设置缓存头后由 http.ServeContent 处理 If-None-Match/If-Modified-Since 和 Range
+func serveImage(c *gin.Context, data []byte, meta storage.ImageMeta, etag string, immutable, private bool) {
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+	if immutable {
+		c.Header("Cache-Control", scope+", max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", scope+", no-cache")
+	}
+	c.Header("Content-Type", meta.Mime)
+	c.Header("ETag", fmt.Sprintf(`"%s"`, etag))
+	http.ServeContent(c.Writer, c.Request, "", meta.UpdateTime, bytes.NewReader(data))
+}
 
-	c.Status(http.StatusOK)
+// imagePath 返回图片地址, variant 为空时为原图
+func imagePath(key string, variant string) string {
+	if variant == "" {
+		return "/" + key
+	}
+	return fmt.Sprintf("/%s?v=%s", key, variant)
+}
 
-	_, err = io.Copy(c.Writer, bytes.NewReader(data))
+// loadImage 读取原图或缩放后的图片, 缩放结果首次生成后缓存
+func loadImage(key string, variant imageVariant, webp bool) ([]byte, storage.ImageMeta, error) {
+	if variant.Name == "" && !webp {
+		return storage.GetImageWithMeta(key)
+	}
+	name := variant.Name
+	if name == "" {
+		name = "origin"
+	}
+	if webp {
+		name += ".webp"
+	}
+	data, meta, err := storage.GetImageVariant(key, name)
+	if err == nil {
+		return data, meta, nil
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, meta, err
+	}
+
+	origin, err := storage.GetImage(key)
+	if err != nil {
+		return nil, meta, err
+	}
+	data, err = renderImageVariant(origin, variant, webp)
 	if err != nil {
-		logrus.Errorf("get image error:%v", err)
+		return nil, meta, err
 	}
+	err = storage.SaveImageVariant(key, name, data)
+	if err != nil {
+		logrus.Errorf("save image:%s variant:%s error:%v", key, name, err)
+	}
+	return data, storage.NewImageMeta(data), nil
+}
+
+// renderImageVariant 生成缩放图, 保持原图格式; webp 只有无损编码, 比原格式大时仍用原格式
+func renderImageVariant(origin []byte, variant imageVariant, webp bool) ([]byte, error) {
+	opts := imaging.AutoOrientation(true)
+	src, err := imaging.Decode(bytes.NewReader(origin), opts)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case variant.Crop:
+		src = imaging.Fill(src, variant.Width, variant.Height, imaging.Center, imaging.Lanczos)
+	case variant.Height > 0:
+		if src.Bounds().Dx() > variant.Width || src.Bounds().Dy() > variant.Height {
+			src = imaging.Fit(src, variant.Width, variant.Height, imaging.Lanczos)
+		}
+	case variant.Width > 0:
+		if src.Bounds().Dx() > variant.Width {
+			src = imaging.Resize(src, variant.Width, 0, imaging.Lanczos)
+		}
+	}
+
+	ext := ".jpg"
+	if http.DetectContentType(origin) == "image/png" {
+		ext = ".png"
+	}
+	data, err := encodeImage(src, 80, ext)
+	if err != nil || !webp {
+		return data, err
+	}
+	webpData, err := encodeImage(src, 80, ".webp")
+	if err != nil {
+		return nil, err
+	}
+	if len(webpData) < len(data) {
+		return webpData, nil
+	}
+	return data, nil
 }
 
 func (h *Handler) PostImage(c *gin.Context) {
@@ -52,88 +211,113 @@ func (h *Handler) PostImage(c *gin.Context) {
 	if idStr != "" {
 		id, _ = strconv.ParseUint(idStr, 10, 64)
 	}
-	fh, err := c.FormFile("avatar")
-	if err != nil {
-		RespInternalError(c, err)
+	lid := c.GetUint64("lid")
+	if lid == 0 {
+		RespMessage(c, "非法租户")
 		return
 	}
-	f, err := fh.Open()
+	lessee, err := getLessee(c, lid)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
-	if err != nil {
-		RespInternalError(c, err)
+	key, ok := uploadImage(c, lessee, "avatar")
+	if !ok {
 		return
 	}
-	if id == 0 {
-		id, err = storage.GenID()
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
+
+	// 图片按内容存储, 不再与商品 id 绑定, id 只原样返回给旧客户端
+	var ack struct {
+		ID       uint64            `json:"id,omitempty"`
+		Path     string            `json:"path"`
+		Origin   string            `json:"origin"`
+		Variants map[string]string `json:"variants"`
 	}
+	ack.ID = id
+	ack.Origin = imagePath(key, "")
+	// path 仍返回 150 的方图, 兼容直接作为商品头像使用
+	ack.Path = imagePath(key, imageVariants["thumb"].Name)
+	ack.Variants = imageVariantPaths(key)
+	Response(c, ack)
+}
 
-	key := storage.GetGoodsAvatarImageKey(id)
-	data, err = compressAndCropSquare(data, 80, 150, path.Ext(fh.Filename))
+// uploadImage 读取表单图片, 压缩后按内容保存, 失败时已写入响应
+func uploadImage(c *gin.Context, lessee storage.Lessee, field string) (string, bool) {
+	data, ext, err := readFormImage(c, field)
+	if err != nil {
+		RespUploadError(c, err)
+		return "", false
+	}
+	data, err = compressAndFit(data, 85, maxImageSize, ext)
 	if err != nil {
 		logrus.Errorf("compress image error:%v", err)
 		RespInternalError(c, err)
-		return
+		return "", false
 	}
-	err = storage.SaveImage(key, data)
+	key, err := saveBlob(lessee, data)
 	if err != nil {
-		RespInternalError(c, err)
-		return
+		RespUploadError(c, err)
+		return "", false
 	}
-	var ack struct {
-		ID   uint64 `json:"id"`
-		Path string `json:"path"`
+	// 列表缩略图上传时直接生成, 其余尺寸首次访问时生成
+	thumb := imageVariants["thumb"]
+	if _, _, err := loadImage(key, thumb, false); err != nil {
+		logrus.Errorf("generate thumb:%s error:%v", key, err)
 	}
-	ack.ID = id
-	ack.Path = fmt.Sprintf("/%s", key)
-	Response(c, ack)
+	return key, true
+}
+
+func imageVariantPaths(key string) map[string]string {
+	variants := make(map[string]string, len(imageVariants))
+	for name := range imageVariants {
+		variants[name] = imagePath(key, name)
+	}
+	return variants
 }
 
-func compressAndCropSquare(data []byte, quality int, toSize int, ext string) ([]byte, error) {
+// saveBlob 计入租户用量后按内容保存, 相同内容只存一份, 未被引用的图片由 GC 回收
+func saveBlob(lessee storage.Lessee, data []byte) (string, error) {
+	key := storage.GetBlobKey(storage.NewImageMeta(data).Hash)
+	err := addImageUsage(lessee, key, len(data))
+	if err != nil {
+		return "", err
+	}
+	_, _, err = storage.SaveBlob(data)
+	if err != nil {
+		storage.DeleteImageUsage(lessee.ID, key)
+		return "", err
+	}
+	return key, nil
+}
+
+// compressAndFit 等比缩放到不超过 maxSize, 不裁剪, 用于需要保留全貌的照片
+func compressAndFit(data []byte, quality int, maxSize int, ext string) ([]byte, error) {
 	opts := imaging.AutoOrientation(true)
 	src, err := imaging.Decode(bytes.NewReader(data), opts)
 	if err != nil {
 		return nil, err
 	}
-	// 获取原始图片尺寸
 	bounds := src.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	// 计算正方形裁剪区域
-	var cropRect image.Rectangle
-	if width > height {
-		// 横向图片，从中心裁剪
-		cropX := (width - height) / 2
-		cropRect = image.Rect(cropX, 0, cropX+height, height)
-	} else {
-		// 纵向图片或正方形，从中心裁剪
-		cropY := (height - width) / 2
-		cropRect = image.Rect(0, cropY, width, cropY+width)
+	if bounds.Dx() > maxSize || bounds.Dy() > maxSize {
+		src = imaging.Fit(src, maxSize, maxSize, imaging.Lanczos)
 	}
+	return encodeImage(src, quality, ext)
+}
 
-	// 裁剪图片
-	croppedImg := imaging.Crop(src, cropRect)
-	croppedImg = imaging.Resize(croppedImg, toSize, toSize, imaging.Lanczos)
-
+func encodeImage(img image.Image, quality int, ext string) ([]byte, error) {
 	var w bytes.Buffer
+	var err error
 	// 根据格式保存图片
 	switch ext {
 	case ".jpg", ".jpeg":
-		err = jpeg.Encode(&w, croppedImg, &jpeg.Options{Quality: quality})
+		err = jpeg.Encode(&w, img, &jpeg.Options{Quality: quality})
 	case ".png":
-		err = png.Encode(&w, croppedImg)
+		err = png.Encode(&w, img)
+	case ".webp":
+		err = nativewebp.Encode(&w, img, nil)
 	default:
 		// 默认使用JPEG格式
-		err = jpeg.Encode(&w, croppedImg, &jpeg.Options{Quality: quality})
+		err = jpeg.Encode(&w, img, &jpeg.Options{Quality: quality})
 	}
 	return w.Bytes(), err
 }
@@ -6,10 +6,11 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 )
 
 func (h Handler) PostJoin(c *gin.Context) {
-	lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lid"))
+	lessee, err := getLessee(c, c.GetUint64("lid"))
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -19,6 +20,26 @@ func (h Handler) PostJoin(c *gin.Context) {
 		RespInternalError(c, err)
 		return
 	}
+	// 申请没有手机号, 按用户地址中的手机号检查
+	addresses, err := storage.Model[storage.Address]().GetAddresses(user.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var phones = make([]string, 0, len(addresses))
+	for _, v := range addresses {
+		phones = append(phones, v.Phone)
+	}
+	block, blocked, err := storage.Model[storage.Block]().Check(lessee.ID, user.ID, phones...)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if blocked {
+		logrus.Infof("user:%d blocked by lessee:%d %s:%s", user.ID, lessee.ID, block.Kind, block.Target)
+		RespMessage(c, "您已被该商家限制申请")
+		return
+	}
 	id, err := storage.GenID()
 	if err != nil {
 		RespInternalError(c, err)
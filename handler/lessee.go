@@ -1,10 +1,13 @@
 package handler
 
 import (
+	"errors"
 	"mall/set"
 	"mall/storage"
+	"sort"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/gin-gonic/gin"
 )
 
@@ -73,9 +76,11 @@ func (h *Handler) GetLesseeList(c *gin.Context) {
 
 func (h *Handler) PutLessee(c *gin.Context) {
 	var req struct {
-		ID     uint64 `uri:"id"`
-		Name   string `json:"name"`
-		Enable bool   `json:"enable"`
+		ID               uint64 `uri:"id"`
+		Name             string `json:"name"`
+		Enable           *bool  `json:"enable"`
+		RequireDonePhoto *bool  `json:"require_done_photo"`
+		ImageQuota       *int64 `json:"image_quota"`
 	}
 	err := c.BindUri(&req)
 	if err != nil {
@@ -88,29 +93,21 @@ func (h *Handler) PutLessee(c *gin.Context) {
 		return
 	}
 
-	user, err := storage.Model[storage.User]().GetByID(c.GetUint64("uid"))
-	if err != nil {
-		RespInternalError(c, err)
+	if req.ImageQuota != nil && *req.ImageQuota < 0 {
+		RespMessage(c, "配额不能小于0")
 		return
 	}
-	if user.Kind != storage.Admin {
-		lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lessee"))
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if !set.From(lessee.Admins).Has(user.ID) {
-			RespMessage(c, "not allow")
-			return
-		}
-	}
 
-	var status = storage.Enabled
-	if !req.Enable {
-		status = storage.Disabled
+	// 未传 enable 时不修改状态
+	var status storage.LesseeStatus
+	if req.Enable != nil {
+		status = storage.Enabled
+		if !*req.Enable {
+			status = storage.Disabled
+		}
 	}
 
-	err = storage.Model[storage.Lessee]().Update(req.ID, req.Name, status)
+	err = storage.Model[storage.Lessee]().Update(req.ID, req.Name, status, req.RequireDonePhoto, req.ImageQuota)
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -134,23 +131,10 @@ func (h *Handler) UpdateLesseeTech(c *gin.Context) {
 		RespBindError(c, err)
 		return
 	}
-	user, err := storage.Model[storage.User]().GetByID(c.GetUint64("uid"))
-	if err != nil {
-		RespInternalError(c, err)
+	if !authorize(c, req.ID, storage.PermMembersManage) {
 		return
 	}
-	if user.Kind != storage.Admin {
-		lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lessee"))
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if !set.From(lessee.Admins).Has(user.ID) {
-			RespMessage(c, "not allow")
-			return
-		}
-	}
-	err = storage.Model[storage.Lessee]().UpdateManger(req.ID, req.Add, req.Del)
+	err = storage.Model[storage.Member]().UpdateRole(req.ID, storage.Technician, req.Add, req.Del)
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -174,23 +158,10 @@ func (h *Handler) UpdateLesseeManager(c *gin.Context) {
 		RespBindError(c, err)
 		return
 	}
-	user, err := storage.Model[storage.User]().GetByID(c.GetUint64("uid"))
-	if err != nil {
-		RespInternalError(c, err)
+	if !authorize(c, req.ID, storage.PermMembersManage) {
 		return
 	}
-	if user.Kind != storage.Admin {
-		lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lessee"))
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if !set.From(lessee.Admins).Has(user.ID) {
-			RespMessage(c, "not allow")
-			return
-		}
-	}
-	err = storage.Model[storage.Lessee]().UpdateTech(req.ID, req.Add, req.Del)
+	err = storage.Model[storage.Member]().UpdateRole(req.ID, storage.Manger, req.Add, req.Del)
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -216,29 +187,290 @@ func (h *Handler) DeleteLessee(c *gin.Context) {
 }
 
 func (h *Handler) GetLesseeMembers(c *gin.Context) {
-	lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lid"))
+	h.getLesseeMembers(c, storage.Technician)
+}
+func (h *Handler) GetLesseeAdmins(c *gin.Context) {
+	h.getLesseeMembers(c, storage.Manger)
+}
+
+// getLesseeMembers 租户中指定角色的用户, 请求中的 role 优先
+func (h *Handler) getLesseeMembers(c *gin.Context, role storage.UserKind) {
+	var req struct {
+		ID   uint64           `uri:"id"`
+		Role storage.UserKind `form:"role"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindQuery(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.Role != "" {
+		role = req.Role
+	}
+	if !authorize(c, req.ID, storage.PermMembersManage) {
+		return
+	}
+	ids, err := storage.Model[storage.Member]().GetMemberIDs(req.ID, role)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	techs, err := storage.Model[storage.User]().GetUsersByIDs(lessee.Techs)
+	users, err := storage.Model[storage.User]().GetUsersByIDs(ids)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	Response(c, techs)
+	Response(c, users)
 }
-func (h *Handler) GetLesseeAdmins(c *gin.Context) {
-	lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lid"))
+
+// UpdateLesseeMember 设置成员角色, 可以是内置角色或自定义角色
+func (h *Handler) UpdateLesseeMember(c *gin.Context) {
+	var req struct {
+		ID   uint64           `uri:"id"`
+		Role storage.UserKind `json:"role"`
+		Add  []uint64         `json:"add"`
+		Del  []uint64         `json:"del"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermMembersManage) {
+		return
+	}
+	member := storage.Member{UserID: c.GetUint64("uid"), LesseeID: req.ID, Role: req.Role}
+	if ok, msg := member.IsValid(); !ok {
+		RespMessage(c, msg)
+		return
+	}
+	_, err = storage.Model[storage.Role]().Get(req.ID, req.Role)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		RespMessage(c, "角色不存在")
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	err = storage.Model[storage.Member]().UpdateRole(req.ID, req.Role, req.Add, req.Del)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	admins, err := storage.Model[storage.User]().GetUsersByIDs(lessee.Admins)
+	Response(c, req.ID)
+}
+
+func (h *Handler) GetLesseeRoles(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermMembersManage) {
+		return
+	}
+	roles, err := storage.Model[storage.Role]().GetRoles(req.ID)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
+	Response(c, roles)
+}
 
-	Response(c, admins)
+// PutLesseeRole 新建或修改自定义角色
+func (h *Handler) PutLesseeRole(c *gin.Context) {
+	var req struct {
+		ID          uint64               `uri:"id"`
+		Name        storage.UserKind     `uri:"name"`
+		Permissions []storage.Permission `json:"permissions"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermMembersManage) {
+		return
+	}
+	var now = time.Now()
+	role, err := storage.Model[storage.Role]().Get(req.ID, req.Name)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		role = storage.Role{LesseeID: req.ID, Name: req.Name, CreateTime: now}
+	} else if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	role.Permissions = set.From(req.Permissions).ToSlice()
+	role.UpdateTime = now
+	if ok, msg := role.IsValid(); !ok {
+		RespMessage(c, msg)
+		return
+	}
+	err = role.Save()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, role)
+}
+
+func (h *Handler) DeleteLesseeRole(c *gin.Context) {
+	var req struct {
+		ID   uint64           `uri:"id"`
+		Name storage.UserKind `uri:"name"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermMembersManage) {
+		return
+	}
+	if storage.IsBuiltinRole(req.Name) {
+		RespMessage(c, "不能删除内置角色")
+		return
+	}
+	members, err := storage.Model[storage.Member]().GetMembers(req.ID, req.Name)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if len(members) > 0 {
+		RespMessage(c, "角色使用中")
+		return
+	}
+	err = storage.Model[storage.Role]().Delete(req.ID, req.Name)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.Name)
+}
+
+func (h *Handler) UpdateLesseeArea(c *gin.Context) {
+	var req struct {
+		ID    uint64                `uri:"id"`
+		Areas []storage.ServiceArea `json:"areas"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	for i := range req.Areas {
+		valid, msg := req.Areas[i].IsValid()
+		if !valid {
+			RespMessage(c, msg)
+			return
+		}
+	}
+	if !authorize(c, req.ID, storage.PermLesseeUpdate) {
+		return
+	}
+	err = storage.Model[storage.Lessee]().UpdateAreas(req.ID, req.Areas)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.ID)
+}
+
+type NearbyLessee struct {
+	storage.Lessee
+	Distance float64 `json:"distance"`
+}
+
+// GetNearbyLessees 列出服务范围覆盖该坐标的租户, 按距离排序; 未设置服务范围的租户不参与
+func (h *Handler) GetNearbyLessees(c *gin.Context) {
+	var req struct {
+		Lat *float64 `form:"lat"`
+		Lng *float64 `form:"lng"`
+	}
+	err := c.BindQuery(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.Lat == nil || req.Lng == nil {
+		RespMessage(c, "坐标为空")
+		return
+	}
+	loc := storage.Location{Lat: *req.Lat, Lng: *req.Lng}
+	if !loc.IsValid() {
+		RespMessage(c, "坐标错误")
+		return
+	}
+	ls, err := storage.Model[storage.Lessee]().GetLessees()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	var nearby = make([]NearbyLessee, 0)
+	for i := range ls {
+		if ls[i].Status != storage.Enabled || len(ls[i].Areas) == 0 {
+			continue
+		}
+		if !ls[i].Serves(&loc) {
+			continue
+		}
+		nearby = append(nearby, NearbyLessee{
+			Lessee:   ls[i],
+			Distance: ls[i].Distance(loc),
+		})
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		return nearby[i].Distance < nearby[j].Distance
+	})
+	Response(c, nearby)
+}
+
+// GetLesseeImageUsage 租户图片存储用量和配额
+func (h *Handler) GetLesseeImageUsage(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	lessee, err := storage.Model[storage.Lessee]().GetByID(req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !authorize(c, req.ID, storage.PermLesseeUpdate) {
+		return
+	}
+	usage, err := storage.GetImageUsage(lessee)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, usage)
 }
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"fmt"
+	"mall/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Limits 接口限流配置, 未配置的项使用默认值, per_minute 小于 0 时不限制
+type Limits struct {
+	Login      ratelimit.Rule `yaml:"login"`
+	Order      ratelimit.Rule `yaml:"order"`
+	Join       ratelimit.Rule `yaml:"join"`
+	Image      ratelimit.Rule `yaml:"image"`
+	OpenOrders int            `yaml:"open_orders"` // 客户在一个租户中未接单的订单上限, 小于 0 时不限制
+}
+
+var defaultLimits = Limits{
+	Login:      ratelimit.Rule{PerMinute: 20, Burst: 10},
+	Order:      ratelimit.Rule{PerMinute: 5, Burst: 3},
+	Join:       ratelimit.Rule{PerMinute: 3, Burst: 3},
+	Image:      ratelimit.Rule{PerMinute: 30, Burst: 20},
+	OpenOrders: 5,
+}
+
+func (l Limits) withDefaults() Limits {
+	for _, v := range []struct {
+		rule *ratelimit.Rule
+		def  ratelimit.Rule
+	}{
+		{&l.Login, defaultLimits.Login},
+		{&l.Order, defaultLimits.Order},
+		{&l.Join, defaultLimits.Join},
+		{&l.Image, defaultLimits.Image},
+	} {
+		if v.rule.PerMinute == 0 {
+			*v.rule = v.def
+		}
+	}
+	if l.OpenOrders == 0 {
+		l.OpenOrders = defaultLimits.OpenOrders
+	}
+	return l
+}
+
+// 同一出口 IP 后可能有多个用户, IP 桶放宽到规则的倍数
+const ipLimitFactor = 5
+
+// RateLimit 每个接口独立限流, 登录用户按用户计数, 不区分租户, 避免切换租户绕过, 未登录时按 IP 计数;
+// 登录用户同时按 IP 计数, 两个桶都有令牌才放行. 需要放在 GetSessionMiddle 之后
+func RateLimit(name string, rule ratelimit.Rule) func(c *gin.Context) {
+	limiter := ratelimit.New(rule)
+	ips := ratelimit.New(ratelimit.Rule{PerMinute: rule.PerMinute * ipLimitFactor, Burst: rule.Burst * ipLimitFactor})
+	return func(c *gin.Context) {
+		key := "ip:" + c.ClientIP()
+		ok, wait := ips.Allow(key)
+		if ok {
+			if uid := c.GetUint64("uid"); uid != 0 {
+				key = fmt.Sprintf("uid:%d", uid)
+			}
+			ok, wait = limiter.Allow(key)
+		}
+		if !ok {
+			logrus.Infof("rate limit %s key:%s retry after:%v", name, key, wait)
+			RespTooManyRequests(c, wait)
+		}
+	}
+}
@@ -1,115 +1,312 @@
 package handler
 
 import (
-	"mall/set"
+	"errors"
 	"mall/storage"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/sirupsen/logrus"
 )
 
+// LesseeMiddle 按请求头 lessee 加载租户, 缓存在请求中, 见 getLessee.
+// id 错误或租户不存在时拒绝请求, 租户是否停用由 ActiveLesseeMiddle 在面向客户的接口上检查
 func LesseeMiddle(c *gin.Context) {
 	lid := c.Request.Header.Get("lessee")
-	if lid != "" {
-		id, err := strconv.Atoi(lid)
-		if err != nil {
-			logrus.Errorf("parse lessee id:%s error", lid)
+	if lid == "" || lid == "0" {
+		return
+	}
+	id, err := strconv.ParseUint(lid, 10, 64)
+	if err != nil {
+		logrus.Infof("parse lessee id:%s error:%v", lid, err)
+		RespMessage(c, "非法租户")
+		c.Abort()
+		return
+	}
+	lessee, err := storage.Model[storage.Lessee]().GetByID(id)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		logrus.Infof("lessee:%d not found", id)
+		RespMessage(c, "租户不存在")
+		c.Abort()
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		c.Abort()
+		return
+	}
+	c.Set("lid", lessee.ID)
+	c.Set("lessee", lessee)
+}
+
+// ActiveLesseeMiddle 停用的租户不能再被客户浏览、下单和申请加入, 平台管理员和租户成员不受限制.
+// 不校验 token, 需要登录的接口放在 GetSessionMiddle 之后才能识别成员
+func ActiveLesseeMiddle(c *gin.Context) {
+	v, ok := c.Get("lessee")
+	if !ok || v.(storage.Lessee).Status != storage.Disabled {
+		return
+	}
+	if role := getRole(c); role != "" && role != storage.Customer {
+		return
+	}
+	logrus.Infof("lessee:%d disabled", c.GetUint64("lid"))
+	c.AbortWithStatusJSON(http.StatusForbidden, Ack[any]{
+		Code:    http.StatusForbidden,
+		Message: "商家已暂停服务",
+	})
+}
+
+// getLessee 当前请求的租户直接从缓存取, 其他租户从库中读取
+func getLessee(c *gin.Context, lid uint64) (storage.Lessee, error) {
+	if v, ok := c.Get("lessee"); ok {
+		if lessee := v.(storage.Lessee); lessee.ID == lid {
+			return lessee, nil
 		}
-		c.Set("lid", uint64(id))
 	}
+	return storage.Model[storage.Lessee]().GetByID(lid)
+}
+
+// authenticate 校验 token 和用户状态, 结果缓存在请求中, 失败时已经响应
+func authenticate(c *gin.Context, jwtSecret string) (storage.User, *tokenClaims, bool) {
+	if v, ok := c.Get("claims"); ok {
+		return c.MustGet("user").(storage.User), v.(*tokenClaims), true
+	}
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "Authorization token required",
+		})
+		return storage.User{}, nil, false
+	}
+
+	claims, err := verifyToken(token, jwtSecret)
+	if err != nil {
+		logrus.Infof("verify token error:%v", err)
+		RespUnauthorized(c)
+		return storage.User{}, nil, false
+	}
+	user, err := storage.Model[storage.User]().GetByOpenID(claims.OpenID)
+	if err != nil || user.ID == 0 {
+		logrus.Errorf("get user by openid:%s error:%v", claims.OpenID, err)
+		RespUnauthorized(c)
+		return storage.User{}, nil, false
+	}
+	// 撤销全部会话后版本增加, 之前的 token 失效
+	if claims.Version != user.TokenVersion {
+		logrus.Infof("user:%d token version:%d expired", user.ID, claims.Version)
+		RespUnauthorized(c)
+		return storage.User{}, nil, false
+	}
+	if rejectSuspended(c, user) {
+		return storage.User{}, nil, false
+	}
+	revoked, err := storage.IsTokenRevoked(claims.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		c.Abort()
+		return storage.User{}, nil, false
+	}
+	if revoked {
+		logrus.Infof("user:%d token:%s revoked", user.ID, claims.ID)
+		RespUnauthorized(c)
+		return storage.User{}, nil, false
+	}
+	c.Set("user", user)
+	c.Set("claims", claims)
+	return user, claims, true
 }
 
 func GetSessionMiddle(jwtSecret string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Authorization token required",
-			})
+		user, _, ok := authenticate(c, jwtSecret)
+		if !ok {
 			return
 		}
 
-		openID := verifyToken(token, jwtSecret)
-		user, err := storage.Model[storage.User]().GetByOpenID(openID)
-		if err != nil || user.ID == 0 {
-			logrus.Errorf("get user by openid:%s error:%v", openID, err)
-			RespUnauthorized(c)
+		role, err := userRole(user, c.GetUint64("lid"))
+		if err != nil {
+			RespInternalError(c, err)
+			c.Abort()
 			return
 		}
 
 		c.Set("uid", user.ID)
-		c.Set("role", string(user.Kind))
-		c.Set("user", user)
+		c.Set("role", string(role))
 	}
 }
 
-func RoleMiddle(roles ...storage.UserKind) func(c *gin.Context) {
-	roleSet := set.From(roles)
+// GetAPIKeyMiddle 带 X-Api-Key 时按租户的集成密钥鉴权, 否则按登录会话.
+// 只用于允许租户后台系统调用的接口, 密钥请求没有 uid
+func GetAPIKeyMiddle(jwtSecret string) func(c *gin.Context) {
+	session := GetSessionMiddle(jwtSecret)
 	return func(c *gin.Context) {
-		role := storage.UserKind(c.GetString("role"))
-		if !roleSet.Has(role) {
-			logrus.Infof("role:%s, forbidden", role)
-			RespForbidden(c)
-			c.Abort()
+		key := c.GetHeader("X-Api-Key")
+		if key == "" {
+			session(c)
+			return
+		}
+		k, err := storage.AuthAPIKey(key)
+		if errors.Is(err, storage.ErrAPIKeyInvalid) {
+			logrus.Infof("api key invalid")
+			RespUnauthorized(c)
 			return
 		}
-		lessee, err := storage.Model[storage.Lessee]().GetByID(c.GetUint64("lid"))
 		if err != nil {
+			RespInternalError(c, err)
+			c.Abort()
+			return
+		}
+		if lid := c.GetUint64("lid"); lid != 0 && lid != k.LesseeID {
+			logrus.Infof("api key:%d of lessee:%d used for lessee:%d", k.ID, k.LesseeID, lid)
 			RespForbidden(c)
+			return
+		}
+		lessee, err := getLessee(c, k.LesseeID)
+		if err != nil {
+			RespInternalError(c, err)
 			c.Abort()
-			logrus.Infof("lessee:%d not found, forbidden", c.GetUint64("lid"))
 			return
 		}
-		switch role {
-		case storage.Manger:
-			if !set.From(lessee.Admins).Has(c.GetUint64("uid")) {
-				RespForbidden(c)
-				c.Abort()
-				logrus.Infof("user:%d is not manager, forbidden", c.GetUint64("uid"))
-				return
-			}
-		case storage.Technician:
-			if !set.From(lessee.Techs).Has(c.GetUint64("uid")) {
-				RespForbidden(c)
-				c.Abort()
-				logrus.Infof("user:%d is not tech, forbidden", c.GetUint64("uid"))
-				return
-			}
+		if lessee.Status == storage.Disabled {
+			logrus.Infof("api key:%d of disabled lessee:%d", k.ID, k.LesseeID)
+			RespForbidden(c)
+			return
+		}
+		c.Set("lid", k.LesseeID)
+		c.Set("lessee", lessee)
+		c.Set("apikey", k)
+	}
+}
+
+func getAPIKey(c *gin.Context) (storage.APIKey, bool) {
+	k, ok := c.Get("apikey")
+	if !ok {
+		return storage.APIKey{}, false
+	}
+	return k.(storage.APIKey), true
+}
+
+// userRole 平台管理员在所有租户中都是管理员, 其他用户按在租户中的成员角色
+func userRole(user storage.User, lid uint64) (storage.UserKind, error) {
+	if user.Kind == storage.Admin {
+		return storage.Admin, nil
+	}
+	return storage.Model[storage.Member]().GetRole(lid, user.ID)
+}
+
+func getRole(c *gin.Context) storage.UserKind {
+	return storage.UserKind(c.GetString("role"))
+}
+
+// RequirePermission 检查用户在当前租户中的权限
+func RequirePermission(perm storage.Permission) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		authorize(c, c.GetUint64("lid"), perm)
+	}
+}
+
+// hasPermission 用户在租户 lid 中是否有权限 perm, 所有鉴权都经过这里.
+// lid 不是当前请求的租户时重新确定角色
+func hasPermission(c *gin.Context, lid uint64, perm storage.Permission) (bool, error) {
+	// 集成密钥只在所属租户内有效, 权限为创建时指定的范围
+	if k, ok := getAPIKey(c); ok {
+		return k.LesseeID == lid && k.HasPermission(perm), nil
+	}
+	role := getRole(c)
+	if lid != c.GetUint64("lid") && role != storage.Admin {
+		user, ok := c.Get("user")
+		if !ok {
+			return false, nil
+		}
+		var err error
+		role, err = userRole(user.(storage.User), lid)
+		if err != nil {
+			return false, err
 		}
 	}
+	return storage.Model[storage.Role]().HasPermission(lid, role, perm)
 }
 
-func verifyToken(tokenString, jwtSecret string) string {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+// rejectSuspended 账号停用时返回 403 和停用信息, 登录、刷新 token 和每个请求都要检查
+func rejectSuspended(c *gin.Context, user storage.User) bool {
+	if !user.IsSuspended(time.Now()) {
+		return false
+	}
+	logrus.Infof("user:%d suspended", user.ID)
+	c.AbortWithStatusJSON(http.StatusForbidden, Ack[*storage.Suspension]{
+		Code:    http.StatusForbidden,
+		Message: "账号已停用",
+		Data:    user.Suspension,
+	})
+	return true
+}
+
+// authorize 没有权限时直接返回 403, 调用方只需判断是否继续
+func authorize(c *gin.Context, lid uint64, perm storage.Permission) bool {
+	ok, err := hasPermission(c, lid, perm)
+	if err != nil {
+		RespInternalError(c, err)
+		c.Abort()
+		return false
+	}
+	if !ok {
+		logrus.Infof("user:%d role:%s has no %s in lessee:%d, forbidden", c.GetUint64("uid"), getRole(c), perm, lid)
+		RespForbidden(c)
+		return false
+	}
+	return true
+}
+
+const (
+	accessTokenTTL  = 2 * time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type tokenClaims struct {
+	OpenID  string `json:"openid"`
+	Version int    `json:"ver"`
+	Session string `json:"sid"` // 签发该 token 的会话, 退出登录时删除
+	jwt.RegisteredClaims
+}
+
+// verifyToken 校验签名和有效期, 没有 jti 的旧 token 不再接受
+func verifyToken(tokenString, jwtSecret string) (*tokenClaims, error) {
+	var claims tokenClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, jwt.ErrSignatureInvalid
 		}
 		return []byte(jwtSecret), nil
 	})
-
-	if err != nil || !token.Valid {
-		return ""
+	if err != nil {
+		return nil, err
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return ""
-	}
-	if v, ok := claims["openid"]; ok {
-		openid, _ := v.(string)
-		return openid
+	if !token.Valid || claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, jwt.ErrTokenInvalidClaims
 	}
-	return ""
+	return &claims, nil
 }
-func generateJWTToken(openid, jwtSecret string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"openid": openid,
-		"exp":    time.Now().AddDate(2000, 0, 0).Unix(), // 不过期
-		"iat":    time.Now().Unix(),
+
+func generateJWTToken(user storage.User, sid, jwtSecret string) (string, error) {
+	jti, err := storage.GenID()
+	if err != nil {
+		return "", err
+	}
+	var now = time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		OpenID:  user.OpenID,
+		Version: user.TokenVersion,
+		Session: sid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        strconv.FormatUint(jti, 10),
+			Subject:   strconv.FormatUint(user.ID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
 	})
 
 	return token.SignedString([]byte(jwtSecret))
@@ -2,8 +2,8 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"mall/set"
 	"mall/storage"
 	"net/http"
 	"sort"
@@ -36,14 +36,12 @@ func (h *Handler) GetOrders(c *gin.Context) {
 		return
 	}
 	uid := c.GetUint64("uid")
+	// 集成密钥没有用户, 只能按租户查看
+	if _, ok := getAPIKey(c); ok {
+		req.Manage = true
+	}
 	logrus.Infof("lid:%d uid:%d get orders:%+v", lid, uid, req)
 
-	user, err := storage.Model[storage.User]().GetByID(uid)
-	if err != nil {
-		logrus.Errorf("get user:%d error:%v", uid, err)
-		RespInternalError(c, err)
-		return
-	}
 	var orders storage.OrderSlice
 
 	if req.Manage {
@@ -53,23 +51,19 @@ func (h *Handler) GetOrders(c *gin.Context) {
 			return
 		}
 		orders = make(storage.OrderSlice, 0, len(oo))
-		lessee, err := storage.Model[storage.Lessee]().GetByID(req.LesseeID)
+		access, err := getOrderAccess(c, req.LesseeID)
 		if err != nil {
 			RespInternalError(c, err)
 			return
 		}
-		if set.From(lessee.Admins).Has(uid) || user.Kind == storage.Admin {
-			orders = oo
-		} else if set.From(lessee.Techs).Has(uid) {
-			for i := range oo {
-				if oo[i].Status == storage.Watting || oo[i].Tech.ID == uid {
-					orders = append(orders, oo[i])
-				}
+		for i := range oo {
+			if access.CanRead(oo[i]) {
+				orders = append(orders, oo[i])
 			}
 		}
 
 	} else {
-		orders, err = storage.Model[storage.Order]().GetByUid(lid, user.ID, req.Status)
+		orders, err = storage.Model[storage.Order]().GetByUid(lid, uid, req.Status)
 		if err != nil {
 			RespInternalError(c, err)
 			return
@@ -103,14 +97,12 @@ func (h *Handler) PreGetOrders(c *gin.Context) {
 		return
 	}
 	uid := c.GetUint64("uid")
+	// 集成密钥没有用户, 只能按租户查看
+	if _, ok := getAPIKey(c); ok {
+		req.Manage = true
+	}
 	logrus.Infof("lid:%d uid:%d get orders:%+v", lid, uid, req)
 
-	user, err := storage.Model[storage.User]().GetByID(uid)
-	if err != nil {
-		logrus.Errorf("get user:%d error:%v", uid, err)
-		RespInternalError(c, err)
-		return
-	}
 	var orders storage.OrderSlice
 
 	if req.Manage {
@@ -120,23 +112,19 @@ func (h *Handler) PreGetOrders(c *gin.Context) {
 			return
 		}
 		orders = make(storage.OrderSlice, 0, len(oo))
-		lessee, err := storage.Model[storage.Lessee]().GetByID(req.LesseeID)
+		access, err := getOrderAccess(c, req.LesseeID)
 		if err != nil {
 			RespInternalError(c, err)
 			return
 		}
-		if set.From(lessee.Admins).Has(uid) || user.Kind == storage.Admin {
-			orders = oo
-		} else if set.From(lessee.Techs).Has(uid) {
-			for i := range oo {
-				if oo[i].Status == storage.Watting || oo[i].Tech.ID == uid {
-					orders = append(orders, oo[i])
-				}
+		for i := range oo {
+			if access.CanRead(oo[i]) {
+				orders = append(orders, oo[i])
 			}
 		}
 
 	} else {
-		orders, err = storage.Model[storage.Order]().GetByUid(lid, user.ID, req.Status)
+		orders, err = storage.Model[storage.Order]().GetByUid(lid, uid, req.Status)
 		if err != nil {
 			RespInternalError(c, err)
 			return
@@ -163,7 +151,6 @@ func (h *Handler) GetOrder(c *gin.Context) {
 		RespBindError(c, err)
 		return
 	}
-	uid := c.GetUint64("uid")
 	lid := c.GetUint64("lid")
 
 	order, err := storage.Model[storage.Order]().GetByID(lid, req.ID)
@@ -171,48 +158,21 @@ func (h *Handler) GetOrder(c *gin.Context) {
 		RespInternalError(c, err)
 		return
 	}
-	if c.Request.Method == http.MethodHead {
-		c.Status(http.StatusNoContent)
-		c.Writer.Header().Set("x-up", storage.MarshalTime(order.UpdateTime))
-		return
-	}
-	if order.User.ID == uid {
-		Response(c, order)
-		return
-	}
-
-	user, err := storage.Model[storage.User]().GetByID(uid)
+	access, err := getOrderAccess(c, lid)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
-	switch user.Kind {
-	case storage.Admin:
-		Response(c, order)
+	if !access.CanRead(order) {
+		RespMessage(c, "not allow")
 		return
-	case storage.Manger:
-		lessee, err := storage.Model[storage.Lessee]().GetByID(lid)
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if set.From(lessee.Admins).Has(uid) {
-			Response(c, order)
-			return
-		}
-	case storage.Technician:
-		lessee, err := storage.Model[storage.Lessee]().GetByID(lid)
-		if err != nil {
-			RespInternalError(c, err)
-			return
-		}
-		if set.From(lessee.Techs).Has(uid) {
-			Response(c, order)
-			return
-		}
 	}
-
-	RespMessage(c, "not allow")
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusNoContent)
+		c.Writer.Header().Set("x-up", storage.MarshalTime(order.UpdateTime))
+		return
+	}
+	Response(c, order)
 }
 
 func (h *Handler) PostOrder(c *gin.Context) {
@@ -220,12 +180,16 @@ func (h *Handler) PostOrder(c *gin.Context) {
 		LesseeID uint64 `json:"lessee_id"`
 		Goods    []struct {
 			ID    uint64 `json:"id"`
+			SkuID uint64 `json:"sku_id"`
 			Count int    `json:"count"`
 		} `json:"goods"`
-		Time    string `json:"time"`
-		Address string `json:"address"`
-		Phone   string `json:"phone"`
-		Remark  string `json:"remark"`
+		Time      string            `json:"time"`
+		AddressID uint64            `json:"address_id"`
+		Contact   string            `json:"contact"`
+		Address   string            `json:"address"`
+		Phone     string            `json:"phone"`
+		Remark    string            `json:"remark"`
+		Location  *storage.Location `json:"location"`
 	}
 
 	err := c.Bind(&req)
@@ -249,14 +213,35 @@ func (h *Handler) PostOrder(c *gin.Context) {
 		return
 	}
 
-	lessee, err := storage.Model[storage.Lessee]().GetByID(req.LesseeID)
+	lessee, err := getLessee(c, req.LesseeID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	// 订单的租户可能不是请求头中的租户, 需要单独检查
+	if lessee.Status == storage.Disabled {
+		RespMessage(c, "商家已暂停服务")
+		return
+	}
+	if h.limits.OpenOrders > 0 {
+		open, err := storage.Model[storage.Order]().GetByUid(lessee.ID, user.ID, storage.Watting)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		if len(open) >= h.limits.OpenOrders {
+			RespMessage(c, fmt.Sprintf("还有%d个订单未接单, 请等待处理后再下单", len(open)))
+			return
+		}
+	}
+	managers, err := storage.Model[storage.Member]().GetMembersWith(lessee.ID, storage.PermOrderRead)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
 	var notifyUser string
-	if len(lessee.Admins) > 0 {
-		manager, err := storage.Model[storage.User]().GetByID(lessee.Admins[0])
+	if len(managers) > 0 {
+		manager, err := storage.Model[storage.User]().GetByID(managers[0])
 		if err != nil {
 			RespInternalError(c, err)
 			return
@@ -270,10 +255,12 @@ func (h *Handler) PostOrder(c *gin.Context) {
 		LesseeID: req.LesseeID,
 		Status:   storage.Watting,
 		Reverse: storage.OrderReverse{
-			Time:    req.Time,
-			Address: req.Address,
-			Phone:   req.Phone,
-			Remark:  req.Remark,
+			Time:     req.Time,
+			Contact:  req.Contact,
+			Address:  req.Address,
+			Phone:    storage.NormalizePhone(req.Phone),
+			Remark:   req.Remark,
+			Location: req.Location,
 		},
 		User: storage.SimpleUser{
 			ID:       user.ID,
@@ -283,6 +270,31 @@ func (h *Handler) PostOrder(c *gin.Context) {
 		UpdateTime: now,
 	}
 
+	if req.AddressID != 0 {
+		address, err := storage.Model[storage.Address]().GetByID(user.ID, req.AddressID)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		order.Reverse.AddressID = address.ID
+		order.Reverse.Contact = address.Contact
+		order.Reverse.Address = address.Address
+		order.Reverse.Phone = address.Phone
+		order.Reverse.Location = address.Location
+	}
+	if !order.Reverse.Location.IsValid() {
+		RespMessage(c, "坐标错误")
+		return
+	}
+	if !lessee.Serves(order.Reverse.Location) {
+		if order.Reverse.Location == nil {
+			RespMessage(c, "请选择定位地址")
+		} else {
+			RespMessage(c, "超出服务范围")
+		}
+		return
+	}
+
 	if order.LesseeID == 0 {
 		order.LesseeID = c.GetUint64("lid")
 	}
@@ -291,6 +303,16 @@ func (h *Handler) PostOrder(c *gin.Context) {
 		RespMessage(c, "非法租户")
 		return
 	}
+	block, blocked, err := storage.Model[storage.Block]().Check(order.LesseeID, user.ID, order.Reverse.Phone)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if blocked {
+		logrus.Infof("user:%d blocked by lessee:%d %s:%s", user.ID, order.LesseeID, block.Kind, block.Target)
+		RespMessage(c, "您已被该商家限制下单")
+		return
+	}
 
 	for _, g := range req.Goods {
 		goods, err := storage.Model[storage.Goods]().GetByID(order.LesseeID, g.ID)
@@ -298,13 +320,41 @@ func (h *Handler) PostOrder(c *gin.Context) {
 			RespInternalError(c, err)
 			return
 		}
-		order.Goods = append(order.Goods, storage.OrderGoods{
+		if g.Count <= 0 {
+			RespMessage(c, "商品数量错误")
+			return
+		}
+		line := storage.OrderGoods{
 			ID:    g.ID,
 			Count: g.Count,
 			Price: goods.FinalPrice,
 			Name:  goods.Name,
-		})
-		order.TotalPrice += goods.FinalPrice * float64(g.Count)
+		}
+		if len(goods.Skus) > 0 {
+			sku, ok := goods.GetSku(g.SkuID)
+			if !ok {
+				RespMessage(c, "请选择规格")
+				return
+			}
+			if sku.Stock < g.Count {
+				RespMessage(c, "库存不足")
+				return
+			}
+			line.SkuID = sku.ID
+			line.SkuName = sku.Name()
+			line.Price = sku.FinalPrice
+		}
+		if rule := goods.ActiveRule(line.SkuID, now); rule != nil && rule.SalePrice < line.Price {
+			if rule.Limit > 0 && rule.Remain() < g.Count {
+				RespMessage(c, "活动商品数量不足")
+				return
+			}
+			line.Price = rule.SalePrice
+			line.RuleID = rule.ID
+			line.RuleName = rule.Name
+		}
+		order.Goods = append(order.Goods, line)
+		order.TotalPrice += line.Price * float64(g.Count)
 	}
 
 	valid, msg := order.IsValid()
@@ -314,6 +364,14 @@ func (h *Handler) PostOrder(c *gin.Context) {
 	}
 
 	err = order.Save()
+	if errors.Is(err, storage.ErrOutOfStock) {
+		RespMessage(c, "库存不足")
+		return
+	}
+	if errors.Is(err, storage.ErrPriceChanged) {
+		RespMessage(c, "活动已结束, 请重新下单")
+		return
+	}
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -371,40 +429,53 @@ func (h *Handler) PutOrder(c *gin.Context) {
 		return
 	}
 
-	lessee, err := storage.Model[storage.Lessee]().GetByID(req.LesseeID)
+	lessee, err := getLessee(c, req.LesseeID)
 	if err != nil {
 		RespInternalError(c, err)
 		return
 	}
 
-	switch status {
-	case storage.Comfirm, storage.Done:
-		switch user.Kind {
-		case storage.Customer:
-			RespForbidden(c)
+	// 修改预约信息: 下单人或有派单权限
+	changed := status != "" && status != order.Status
+	if !changed || req.Address != "" || req.Time != "" || req.Phone != "" {
+		if !authorizeOrderOwner(c, user, order, storage.PermOrderAssign) {
 			return
-		case storage.Technician, storage.Manger:
-			if !set.From(lessee.Admins).Has(user.ID) && !set.From(lessee.Techs).Has(user.ID) {
-				RespForbidden(c)
-				return
-			}
 		}
-	case storage.Canceled:
-		switch user.Kind {
-		case storage.Customer:
-			if user.ID != order.User.ID {
-				RespForbidden(c)
+	}
+	// 修改状态: 取消可以是下单人, 其余 (包括退回待确认) 都需要派单权限
+	if changed {
+		if status == storage.Canceled {
+			if !authorizeOrderOwner(c, user, order, storage.PermOrderCancel) {
 				return
 			}
-		case storage.Technician, storage.Manger:
-			if !set.From(lessee.Admins).Has(user.ID) && !set.From(lessee.Techs).Has(user.ID) {
-				RespForbidden(c)
-				return
+		} else if !authorize(c, req.LesseeID, storage.PermOrderAssign) {
+			return
+		}
+	}
+
+	if status == storage.Done && order.Status != storage.Done && lessee.RequireDonePhoto {
+		attachments, err := storage.Model[storage.OrderAttachment]().GetAttachments(req.LesseeID, req.ID)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		var photos int
+		for _, v := range attachments {
+			if v.Kind != storage.Signature {
+				photos++
 			}
 		}
+		if photos == 0 {
+			RespMessage(c, "请先上传服务照片")
+			return
+		}
 	}
 
-	old, err := storage.Model[storage.Order]().Update(req.LesseeID, req.ID, req.Address, req.Time, req.Phone, status)
+	old, err := storage.Model[storage.Order]().Update(req.LesseeID, req.ID, req.Address, req.Time, storage.NormalizePhone(req.Phone), status)
+	if errors.Is(err, storage.ErrOrderStatus) {
+		RespMessage(c, "订单已结束或状态不能这样修改")
+		return
+	}
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -422,6 +493,14 @@ func (h *Handler) PutOrder(c *gin.Context) {
 	Response(c, req)
 }
 
+// authorizeOrderOwner 下单人本人或有 perm 权限
+func authorizeOrderOwner(c *gin.Context, user storage.User, order storage.Order, perm storage.Permission) bool {
+	if user.ID == order.User.ID {
+		return true
+	}
+	return authorize(c, order.LesseeID, perm)
+}
+
 func (h *Handler) DeleteOrder(c *gin.Context) {
 	var req struct {
 		ID uint64 `uri:"id"`
@@ -443,6 +522,65 @@ func (h *Handler) DeleteOrder(c *gin.Context) {
 	}
 }
 
+// orderAccess 用户在租户中可以查看的订单
+type orderAccess struct {
+	uid     uint64
+	all     bool // order.read
+	watting bool // order.assign, 可以查看待接单的订单
+}
+
+func getOrderAccess(c *gin.Context, lid uint64) (orderAccess, error) {
+	var access = orderAccess{uid: c.GetUint64("uid")}
+	var err error
+	access.all, err = hasPermission(c, lid, storage.PermOrderRead)
+	if err != nil {
+		return access, err
+	}
+	access.watting, err = hasPermission(c, lid, storage.PermOrderAssign)
+	return access, err
+}
+
+// CanRead 下单客户和指派师傅总是可以查看
+func (a orderAccess) CanRead(order storage.Order) bool {
+	if order.User.ID == a.uid || (order.Tech.ID != 0 && order.Tech.ID == a.uid) {
+		return true
+	}
+	return a.all || (a.watting && order.Status == storage.Watting)
+}
+
+func (h *Handler) loadParticipantOrder(c *gin.Context, oid uint64) (storage.User, storage.Lessee, storage.Order, bool) {
+	lid := c.GetUint64("lid")
+	if lid == 0 {
+		RespMessage(c, "非法租户")
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	user, err := storage.Model[storage.User]().GetByID(c.GetUint64("uid"))
+	if err != nil {
+		RespInternalError(c, err)
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	order, err := storage.Model[storage.Order]().GetByID(lid, oid)
+	if err != nil {
+		RespInternalError(c, err)
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	lessee, err := getLessee(c, lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	access, err := getOrderAccess(c, lid)
+	if err != nil {
+		RespInternalError(c, err)
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	if !access.CanRead(order) {
+		RespForbidden(c)
+		return storage.User{}, storage.Lessee{}, storage.Order{}, false
+	}
+	return user, lessee, order, true
+}
+
 func (h *Handler) SendNewOrderMessage(openid string, order *storage.Order) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -480,7 +618,7 @@ func (h *Handler) SendNewOrderMessage(openid string, order *storage.Order) error
 	if err != nil {
 		return err
 	}
-	logrus.Infof("send new order notify code: %d, msg:", result.Code, result.ResultMsg)
+	logrus.Infof("send new order notify code: %s, msg:%s", result.Code, result.ResultMsg)
 	return nil
 }
 
@@ -549,6 +687,34 @@ func (h *Handler) SendCancelOrderMessage(openid string, order *storage.Order) er
 	return nil
 }
 
+// SendCommentOrderMessage 订单有新留言, 没有单独的模板, 使用订单变更的模板
+func (h *Handler) SendCommentOrderMessage(openid string, order *storage.Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	data := &power.HashMap{
+		"thing1": map[string]string{
+			"value": order.Reverse.Address,
+		},
+		"date10": map[string]string{
+			"value": order.Reverse.Time,
+		},
+	}
+	result, err := h.wxApp.SubscribeMessage.Send(ctx, &request.RequestSubscribeMessageSend{
+		ToUser:           openid,
+		TemplateID:       "WR3oyAQ_sgIXOBd3gBsMWWi1c-gHJ03rAc-zJc9978s",
+		Page:             "pages/order/order",
+		Data:             data,
+		Lang:             "zh_CN",
+		MiniProgramState: "formal",
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("send order comment notify code: %s, msg:%s", result.Code, result.ResultMsg)
+	return nil
+}
+
 func (h *Handler) SendUpdateTimeOrderMessage(openid string, order *storage.Order) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
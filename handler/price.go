@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"mall/storage"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *Handler) PostPriceRule(c *gin.Context) {
+	var req struct {
+		ID        uint64    `uri:"id"`
+		Name      string    `json:"name"`
+		SkuID     uint64    `json:"sku_id"`
+		SalePrice float64   `json:"sale_price"`
+		Limit     int       `json:"limit"`
+		StartTime time.Time `json:"start_time"`
+		EndTime   time.Time `json:"end_time"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	id, err := storage.GenID()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	rule := storage.PriceRule{
+		ID:        id,
+		Name:      req.Name,
+		SkuID:     req.SkuID,
+		SalePrice: req.SalePrice,
+		Limit:     req.Limit,
+		StartTime: req.StartTime,
+		EndTime:   req.EndTime,
+	}
+	ok, msg := rule.IsValid()
+	if !ok {
+		RespMessage(c, msg)
+		return
+	}
+	err = storage.Model[storage.Goods]().AddPriceRule(c.GetUint64("lid"), req.ID, rule)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, rule)
+}
+
+func (h *Handler) DeletePriceRule(c *gin.Context) {
+	var req struct {
+		ID  uint64 `uri:"id"`
+		RID uint64 `uri:"rid"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	err = storage.Model[storage.Goods]().DeletePriceRule(c.GetUint64("lid"), req.ID, req.RID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, req.RID)
+}
+
+func (h *Handler) GetPriceHistory(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	history, err := storage.Model[storage.PriceHistory]().GetHistory(c.GetUint64("lid"), req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	sort.Sort(sort.Reverse(history))
+	Response(c, history)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"errors"
+	"mall/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type TokenAck struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // access token 有效秒数
+}
+
+// issueTokens 新建会话并签发 access token 和 refresh token
+func (h *Handler) issueTokens(user storage.User) (TokenAck, error) {
+	session, refresh, err := storage.CreateSession(user.ID, user.TokenVersion, refreshTokenTTL)
+	if err != nil {
+		return TokenAck{}, err
+	}
+	token, err := generateJWTToken(user, session.ID, h.jwtSecret)
+	if err != nil {
+		return TokenAck{}, err
+	}
+	return TokenAck{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+	}, nil
+}
+
+// RefreshToken 用 refresh token 换新的 token, 旧的 refresh token 同时失效
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	session, refresh, err := storage.RotateSession(req.RefreshToken, refreshTokenTTL)
+	if errors.Is(err, storage.ErrSessionInvalid) || errors.Is(err, storage.ErrRefreshReused) {
+		logrus.Infof("refresh token error:%v", err)
+		RespUnauthorized(c)
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	user, err := storage.Model[storage.User]().GetByID(session.UserID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if session.Version != user.TokenVersion {
+		err = storage.Model[storage.Session]().Delete(session.UserID, session.ID)
+		if err != nil {
+			RespInternalError(c, err)
+			return
+		}
+		RespUnauthorized(c)
+		return
+	}
+	if rejectSuspended(c, user) {
+		return
+	}
+	token, err := generateJWTToken(user, session.ID, h.jwtSecret)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, TokenAck{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+	})
+}
+
+// Logout 撤销当前 access token 并删除会话
+func (h *Handler) Logout(c *gin.Context) {
+	claims := c.MustGet("claims").(*tokenClaims)
+	err := storage.RevokeToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	err = storage.Model[storage.Session]().Delete(c.GetUint64("uid"), claims.Session)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, "")
+}
+
+// RevokeUserTokens 撤销用户的所有会话, 本人或平台管理员
+func (h *Handler) RevokeUserTokens(c *gin.Context) {
+	var req struct {
+		ID uint64 `uri:"id"`
+	}
+	err := c.BindUri(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if req.ID != c.GetUint64("uid") && !authorize(c, c.GetUint64("lid"), storage.PermPlatform) {
+		return
+	}
+	err = storage.Model[storage.User]().RevokeTokens(req.ID)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d revoke tokens of user:%d", c.GetUint64("uid"), req.ID)
+	Response(c, req.ID)
+}
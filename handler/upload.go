@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mall/storage"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxUploadSize  = 10 << 20   // 单张图片上传上限
+	maxImageSide   = 16384      // 解码前检查, 防止解压炸弹
+	maxImagePixels = 50_000_000 // 约 5000 万像素, 覆盖常见手机原图
+)
+
+// 上传图片失败的错误码
+const (
+	CodeUploadMissing   = 4100 // 未选择文件
+	CodeUploadTooLarge  = 4101 // 文件过大
+	CodeUploadFormat    = 4102 // 不是支持的图片格式
+	CodeUploadDimension = 4103 // 图片尺寸过大
+	CodeUploadQuota     = 4104 // 超出租户存储配额
+)
+
+type uploadError struct {
+	Code int
+	Msg  string
+}
+
+func (e *uploadError) Error() string {
+	return e.Msg
+}
+
+var (
+	errUploadMissing   = &uploadError{CodeUploadMissing, "请选择图片"}
+	errUploadTooLarge  = &uploadError{CodeUploadTooLarge, fmt.Sprintf("图片不能超过%dM", maxUploadSize>>20)}
+	errUploadFormat    = &uploadError{CodeUploadFormat, "只支持 jpg、png、webp 格式的图片"}
+	errUploadDimension = &uploadError{CodeUploadDimension, "图片尺寸过大"}
+	errUploadQuota     = &uploadError{CodeUploadQuota, "图片存储空间已用完"}
+)
+
+// 按内容识别的格式对应保存时的扩展名; webp 只有无损编码, 转为 jpg 保存
+var uploadFormats = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"webp": ".jpg",
+}
+
+// readFormImage 读取上传的图片文件, 按内容识别格式并在解码前检查尺寸, 返回内容和保存用的扩展名
+func readFormImage(c *gin.Context, field string) ([]byte, string, error) {
+	// 多留 1M 给表单其它字段
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1<<20)
+	fh, err := c.FormFile(field)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, "", errUploadTooLarge
+	}
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, "", errUploadMissing
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if fh.Size > maxUploadSize {
+		return nil, "", errUploadTooLarge
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxUploadSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxUploadSize {
+		return nil, "", errUploadTooLarge
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUploadFormat
+	}
+	ext, ok := uploadFormats[format]
+	if !ok {
+		return nil, "", errUploadFormat
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxImageSide || cfg.Height > maxImageSide ||
+		cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", errUploadDimension
+	}
+	return data, ext, nil
+}
+
+// addImageUsage 计入租户图片用量, 超出配额时返回 errUploadQuota
+func addImageUsage(lessee storage.Lessee, key string, size int) error {
+	err := storage.AddImageUsage(lessee, key, size)
+	if errors.Is(err, storage.ErrImageQuota) {
+		return errUploadQuota
+	}
+	return err
+}
+
+// RespUploadError 上传校验失败时返回对应错误码, 其它错误按内部错误处理
+func RespUploadError(c *gin.Context, err error) {
+	var e *uploadError
+	if errors.As(err, &e) {
+		RespCode(c, e.Code, e.Msg)
+		return
+	}
+	RespInternalError(c, err)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"mall/storage"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -11,8 +12,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const AdminOpenID = "o5v6w7QsaAkT4ciLRmNQkt5ibQUw"
-
 func (h *Handler) PreLogin(c *gin.Context) {
 	user, err := storage.Model[storage.User]().GetByID(c.GetUint64("uid"))
 	if err != nil {
@@ -65,27 +64,21 @@ func (h *Handler) Login(c *gin.Context) {
 		user = storage.User{
 			ID:         id,
 			OpenID:     session.OpenID,
+			UnionID:    session.UnionID,
 			Avatar:     req.AvatarURL,
 			Nickname:   req.Nickname,
+			Kind:       storage.Customer,
 			CreateTime: now,
 			UpdateTime: now,
 		}
-		if user.OpenID == AdminOpenID {
-			user.Kind = storage.Admin
-		} else {
-			user.Kind = storage.Customer
-		}
 		err = user.Save()
 		if err != nil {
 			RespInternalError(c, err)
 			return
 		}
 	} else {
-		if user.OpenID == AdminOpenID {
-			user.Kind = storage.Admin
-		} else {
-			user.Kind = storage.Customer
-		}
+		// 角色由配置, 命令行和租户成员决定, 登录不修改
+		user.UnionID = session.UnionID
 		user.Avatar = req.AvatarURL
 		user.Nickname = req.Nickname
 		user.UpdateTime = now
@@ -95,8 +88,11 @@ func (h *Handler) Login(c *gin.Context) {
 			return
 		}
 	}
+	if rejectSuspended(c, user) {
+		return
+	}
 
-	token, err := generateJWTToken(session.OpenID, h.jwtSecret)
+	ack, err := h.issueTokens(user)
 	if err != nil {
 		RespInternalError(c, err)
 		return
@@ -105,15 +101,16 @@ func (h *Handler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"openid": session.OpenID,
 		// "session_key": session.SessionKey, // 注意：实际生产环境不应返回给前端
-		"token":    token,
-		"userinfo": user,
+		"token":         ack.Token,
+		"refresh_token": ack.RefreshToken,
+		"expires_in":    ack.ExpiresIn,
+		"userinfo":      user,
 	})
 }
 
 func (h *Handler) PutUser(c *gin.Context) {
 	var req struct {
 		ID       uint64 `uri:"id"`
-		Kind     string `json:"kind"`
 		Avatar   string `json:"avatar"`
 		Nickname string `json:"nickname"`
 	}
@@ -127,8 +124,10 @@ func (h *Handler) PutUser(c *gin.Context) {
 		RespBindError(c, err)
 		return
 	}
+	if req.ID != c.GetUint64("uid") && !authorize(c, c.GetUint64("lid"), storage.PermPlatform) {
+		return
+	}
 	var user = &storage.User{
-		Kind:     storage.UserKind(req.Kind),
 		Avatar:   req.Avatar,
 		Nickname: req.Nickname,
 	}
@@ -141,6 +140,16 @@ func (h *Handler) PutUser(c *gin.Context) {
 	Response(c, user)
 }
 
+// GetUserMembers 当前用户加入的租户和角色
+func (h *Handler) GetUserMembers(c *gin.Context) {
+	members, err := storage.Model[storage.Member]().GetByUser(c.GetUint64("uid"))
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	Response(c, members)
+}
+
 func (h *Handler) GetUsers(c *gin.Context) {
 	users, err := storage.Model[storage.User]().GetUsers()
 	if err != nil {
@@ -192,13 +201,8 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 		RespInternalError(c, err)
 		return
 	}
-	switch user.Kind {
-	case storage.Admin:
-	default:
-		if req.ID != user.ID {
-			RespForbidden(c)
-			return
-		}
+	if req.ID != user.ID && !authorize(c, c.GetUint64("lid"), storage.PermPlatform) {
+		return
 	}
 	deletedUser, err := storage.Model[storage.User]().GetByID(req.ID)
 	if err != nil {
@@ -214,3 +218,16 @@ func (h *Handler) DeleteUser(c *gin.Context) {
 	logrus.Infof("user:%s delete user:%s", user.Nickname, deletedUser.Nickname)
 	Response(c, req.ID)
 }
+
+// GetAdminAudits 平台管理员变更记录, 按时间倒序
+func (h *Handler) GetAdminAudits(c *gin.Context) {
+	audits, err := storage.Model[storage.AdminAudit]().GetAudits()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	sort.Slice(audits, func(i, j int) bool {
+		return audits[i].ID > audits[j].ID
+	})
+	Response(c, audits)
+}
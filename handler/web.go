@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"errors"
+	"mall/storage"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// oauthStateCookie 把 state 绑定到发起登录的浏览器, 回调时校验, 防止登录 CSRF
+const oauthStateCookie = "oauth_state"
+
+func setOAuthStateCookie(c *gin.Context, state string, maxAge int) {
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthStateCookie, state, maxAge, "/api/v1/web", "", secure, true)
+}
+
+// GetWebLoginURL 网页扫码登录的二维码地址
+func (h *Handler) GetWebLoginURL(c *gin.Context) {
+	if h.webOAuth == nil {
+		RespMessage(c, "未开启网页登录")
+		return
+	}
+	state, err := storage.NewOAuthState()
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	setOAuthStateCookie(c, state, int(storage.OAuthStateTTL.Seconds()))
+	Response(c, gin.H{
+		"url":   h.webOAuth.AuthURL(state),
+		"state": state,
+	})
+}
+
+// WebLogin 扫码后用 code 登录, 按 UnionID 找到小程序用户, 签发与小程序相同的 token.
+// 没有在小程序登录过的用户不能登录网页
+func (h *Handler) WebLogin(c *gin.Context) {
+	var req struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		RespBindError(c, err)
+		return
+	}
+	if h.webOAuth == nil {
+		RespMessage(c, "未开启网页登录")
+		return
+	}
+	// 只接受本浏览器发起的登录, state 不论是否匹配都作废
+	cookie, _ := c.Cookie(oauthStateCookie)
+	setOAuthStateCookie(c, "", -1)
+	ok, err := storage.TakeOAuthState(req.State)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if !ok {
+		RespMessage(c, "二维码已过期, 请重新扫码")
+		return
+	}
+	if cookie == "" || cookie != req.State {
+		logrus.Infof("web login state not bound to this browser")
+		RespMessage(c, "登录状态不匹配, 请在同一浏览器中重新扫码")
+		return
+	}
+	info, err := h.webOAuth.Exchange(c.Request.Context(), req.Code)
+	if err != nil {
+		logrus.Errorf("web oauth exchange error:%v", err)
+		RespUnauthorized(c)
+		return
+	}
+	if info.UnionID == "" {
+		RespMessage(c, "未获取到 UnionID, 请确认网站应用与小程序已绑定同一开放平台")
+		return
+	}
+	user, err := storage.Model[storage.User]().GetByUnionID(info.UnionID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		RespMessage(c, "请先在小程序中登录")
+		return
+	}
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	if rejectSuspended(c, user) {
+		return
+	}
+
+	ack, err := h.issueTokens(user)
+	if err != nil {
+		RespInternalError(c, err)
+		return
+	}
+	logrus.Infof("user:%d web login", user.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"openid":        user.OpenID,
+		"token":         ack.Token,
+		"refresh_token": ack.RefreshToken,
+		"expires_in":    ack.ExpiresIn,
+		"userinfo":      user,
+	})
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"mall/handler"
+	"mall/oauth"
 	"mall/storage"
 	"os"
 	"os/signal"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
@@ -23,12 +27,49 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	store, err := storage.NewImageStore(cfg.Image, "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	storage.SetImageStore(store)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate-images" {
+		migrateImages(cfg, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		adminCommand(os.Args[2:])
+		return
+	}
+
 	e := gin.Default()
+	err = e.SetTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	storage.Init("db")
+	err = storage.Init("db")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	defer storage.Close()
 
-	handler.NewHandler(e, cfg.Mini.AppID, cfg.Mini.Secret, cfg.Jwt.Secret)
+	err = storage.GrantAdmins(cfg.Admins, "config")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	webOAuth, err := newWebOAuth(cfg.Open, cfg.Debug)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	handler.NewHandler(e, cfg.Mini.AppID, cfg.Mini.Secret, cfg.Jwt.Secret, webOAuth, cfg.Limit)
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
@@ -38,3 +79,112 @@ func main() {
 	<-ch
 
 }
+
+// newWebOAuth 未配置网站应用时不开启网页登录.
+// fake 任何人都能用任意 UnionID 登录, 只允许在 debug 下使用
+func newWebOAuth(cfg OpenApp, debug bool) (oauth.Client, error) {
+	if cfg.Fake {
+		if !debug {
+			return nil, errors.New("open.fake allows login as any user, it requires debug: true")
+		}
+		logrus.Warn("!!! open.fake is enabled: web login accepts any code as UnionID, never use it in production !!!")
+		return oauth.NewFake(cfg.Redirect), nil
+	}
+	if cfg.AppID == "" {
+		return nil, nil
+	}
+	return oauth.NewWechat(cfg.AppID, cfg.Secret, cfg.Redirect), nil
+}
+
+// migrateImages 把图片从 -from 指定的存储复制到配置中使用的存储
+//
+//	mall migrate-images -from badger [-delete]
+//
+// 需要打开 db 目录, 执行前必须先停止服务, 否则 badger 目录被占用无法打开;
+// 服务运行中写入的图片也不会被复制
+func migrateImages(cfg Config, args []string) {
+	fs := flag.NewFlagSet("migrate-images", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mall migrate-images -from badger|fs|s3 [-delete]")
+		fmt.Fprintln(fs.Output(), "the server must be stopped first, this command opens the db directory")
+		fs.PrintDefaults()
+	}
+	from := fs.String("from", storage.BadgerImageStore, "source image store: badger, fs, s3")
+	del := fs.Bool("delete", false, "delete images from source after copy")
+	fs.Parse(args)
+
+	if *from == cfg.Image.Store || (*from == storage.BadgerImageStore && cfg.Image.Store == "") {
+		fmt.Println("source and target image store are the same")
+		return
+	}
+	src, err := storage.NewImageStore(cfg.Image, *from)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = storage.Init("db")
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("make sure the server is stopped before migrating images")
+		return
+	}
+	defer storage.Close()
+
+	count, err := storage.MigrateImages(src, storage.GetImageStore(), *del)
+	if err != nil {
+		fmt.Printf("migrate images error after %d images: %v\n", count, err)
+		return
+	}
+	fmt.Printf("migrated %d images\n", count)
+}
+
+// adminCommand 管理平台管理员
+//
+//	mall admin grant -openid xxx
+//	mall admin revoke -openid xxx
+//	mall admin list
+func adminCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: mall admin grant|revoke|list [-openid openid]")
+		return
+	}
+	fs := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	openid := fs.String("openid", "", "openid of the user")
+	fs.Parse(args[1:])
+
+	err := storage.Init("db")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer storage.Close()
+
+	switch args[0] {
+	case "grant", "revoke":
+		if *openid == "" {
+			fmt.Println("-openid is required")
+			return
+		}
+		changed, err := storage.SetAdmin(*openid, storage.AdminAction(args[0]), "cli")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if !changed {
+			fmt.Println("nothing changed")
+			return
+		}
+		fmt.Printf("%s admin %s done\n", args[0], *openid)
+	case "list":
+		admins, err := storage.Model[storage.User]().GetAdmins()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, u := range admins {
+			fmt.Printf("%d\t%s\t%s\n", u.ID, u.OpenID, u.Nickname)
+		}
+	default:
+		fmt.Printf("unknown admin command: %s\n", args[0])
+	}
+}
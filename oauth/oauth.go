@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// User 扫码登录得到的用户信息, UnionID 用于关联小程序用户
+type User struct {
+	OpenID   string
+	UnionID  string
+	Nickname string
+	Avatar   string
+}
+
+// Client 网页扫码登录
+type Client interface {
+	// AuthURL 二维码页面地址, 扫码后带着 code 和 state 跳转到回调地址
+	AuthURL(state string) string
+	Exchange(ctx context.Context, code string) (User, error)
+}
+
+const wechatAPI = "https://api.weixin.qq.com"
+
+// Wechat 微信开放平台网站应用
+type Wechat struct {
+	appID    string
+	secret   string
+	redirect string
+	api      string
+	client   *http.Client
+}
+
+func NewWechat(appID, secret, redirect string) *Wechat {
+	return &Wechat{
+		appID:    appID,
+		secret:   secret,
+		redirect: redirect,
+		api:      wechatAPI,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *Wechat) AuthURL(state string) string {
+	q := url.Values{}
+	q.Set("appid", w.appID)
+	q.Set("redirect_uri", w.redirect)
+	q.Set("response_type", "code")
+	q.Set("scope", "snsapi_login")
+	q.Set("state", state)
+	return "https://open.weixin.qq.com/connect/qrconnect?" + q.Encode() + "#wechat_redirect"
+}
+
+type wechatError struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (w *Wechat) get(ctx context.Context, path string, q url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.api+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wechat %s status:%d", path, resp.StatusCode)
+	}
+	var data json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return err
+	}
+	var werr wechatError
+	if json.Unmarshal(data, &werr) == nil && werr.ErrCode != 0 {
+		return fmt.Errorf("wechat %s error:%d %s", path, werr.ErrCode, werr.ErrMsg)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (w *Wechat) Exchange(ctx context.Context, code string) (User, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+		OpenID      string `json:"openid"`
+		UnionID     string `json:"unionid"`
+	}
+	err := w.get(ctx, "/sns/oauth2/access_token", url.Values{
+		"appid":      {w.appID},
+		"secret":     {w.secret},
+		"code":       {code},
+		"grant_type": {"authorization_code"},
+	}, &token)
+	if err != nil {
+		return User{}, err
+	}
+	var info struct {
+		OpenID     string `json:"openid"`
+		UnionID    string `json:"unionid"`
+		Nickname   string `json:"nickname"`
+		HeadImgURL string `json:"headimgurl"`
+	}
+	err = w.get(ctx, "/sns/userinfo", url.Values{
+		"access_token": {token.AccessToken},
+		"openid":       {token.OpenID},
+	}, &info)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		OpenID:   token.OpenID,
+		UnionID:  token.UnionID,
+		Nickname: info.Nickname,
+		Avatar:   info.HeadImgURL,
+	}
+	if user.UnionID == "" {
+		user.UnionID = info.UnionID
+	}
+	return user, nil
+}
+
+// Fake 本地测试用, 不请求微信. code 即为 UnionID
+type Fake struct {
+	redirect string
+}
+
+func NewFake(redirect string) *Fake {
+	return &Fake{redirect: redirect}
+}
+
+func (f *Fake) AuthURL(state string) string {
+	sep := "?"
+	if strings.Contains(f.redirect, "?") {
+		sep = "&"
+	}
+	return f.redirect + sep + url.Values{"state": {state}}.Encode()
+}
+
+func (f *Fake) Exchange(ctx context.Context, code string) (User, error) {
+	if code == "" {
+		return User{}, fmt.Errorf("empty code")
+	}
+	return User{
+		OpenID:   "fake-" + code,
+		UnionID:  code,
+		Nickname: code,
+	}, nil
+}
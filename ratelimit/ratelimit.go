@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Rule 令牌桶规则, 每分钟补充 PerMinute 个令牌, 最多攒 Burst 个
+type Rule struct {
+	PerMinute int `yaml:"per_minute"`
+	Burst     int `yaml:"burst"` // 默认等于 PerMinute
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter 按 key 分桶的令牌桶, 只在内存中, 重启后清空
+type Limiter struct {
+	rate  float64 // 每秒补充的令牌
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New PerMinute 不大于 0 时不限制
+func New(rule Rule) *Limiter {
+	burst := rule.Burst
+	if burst <= 0 {
+		burst = rule.PerMinute
+	}
+	return &Limiter{
+		rate:      float64(rule.PerMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow 取一个令牌, 没有令牌时返回还需等待的时间
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	var now = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep 每分钟清理一次已经补满的桶, 补满的桶和新建的没有区别
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Field 参与索引的文本, Weight 为该字段命中时的权重
+type Field struct {
+	Text   string
+	Weight float64
+}
+
+type Result struct {
+	ID    uint64
+	Score float64
+}
+
+// Index 内存倒排索引, 按字符 n-gram 切分, 不依赖中文分词
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[uint64]float64 // gram -> 文档 -> 加权词频
+	docs     map[uint64][]string           // 文档包含的 gram, 删除时使用
+}
+
+func New() *Index {
+	return &Index{
+		postings: make(map[string]map[uint64]float64),
+		docs:     make(map[uint64][]string),
+	}
+}
+
+// runs 转小写后按字母和数字切成连续片段, 标点和空格作为分隔
+func runs(s string) [][]rune {
+	var rs [][]rune
+	var cur []rune
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur = append(cur, r)
+			continue
+		}
+		if len(cur) > 0 {
+			rs = append(rs, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		rs = append(rs, cur)
+	}
+	return rs
+}
+
+// Tokenize 索引用的 gram: 单字和相邻两字
+func Tokenize(s string) []string {
+	var grams []string
+	for _, run := range runs(s) {
+		for i := range run {
+			grams = append(grams, string(run[i]))
+			if i+1 < len(run) {
+				grams = append(grams, string(run[i:i+2]))
+			}
+		}
+	}
+	return grams
+}
+
+// queryGrams 查询用的 gram: 单字的片段用单字, 其余用相邻两字
+func queryGrams(q string) []string {
+	var grams []string
+	seen := make(map[string]bool)
+	for _, run := range runs(q) {
+		if len(run) == 1 {
+			if !seen[string(run)] {
+				seen[string(run)] = true
+				grams = append(grams, string(run))
+			}
+			continue
+		}
+		for i := 0; i+1 < len(run); i++ {
+			g := string(run[i : i+2])
+			if !seen[g] {
+				seen[g] = true
+				grams = append(grams, g)
+			}
+		}
+	}
+	return grams
+}
+
+// Put 添加或替换文档
+func (ix *Index) Put(id uint64, fields ...Field) {
+	tf := make(map[string]float64)
+	for _, f := range fields {
+		for _, g := range Tokenize(f.Text) {
+			tf[g] += f.Weight
+		}
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(id)
+	grams := make([]string, 0, len(tf))
+	for g, w := range tf {
+		docs, ok := ix.postings[g]
+		if !ok {
+			docs = make(map[uint64]float64)
+			ix.postings[g] = docs
+		}
+		docs[id] = w
+		grams = append(grams, g)
+	}
+	ix.docs[id] = grams
+}
+
+func (ix *Index) Delete(id uint64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(id)
+}
+
+func (ix *Index) delete(id uint64) {
+	for _, g := range ix.docs[id] {
+		delete(ix.postings[g], id)
+		if len(ix.postings[g]) == 0 {
+			delete(ix.postings, g)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// Search 返回包含查询中所有 gram 的文档, 按 tf-idf 得分从高到低
+func (ix *Index) Search(q string) []Result {
+	grams := queryGrams(q)
+	if len(grams) == 0 {
+		return nil
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	// 从最短的倒排表开始求交集
+	lists := make([]map[uint64]float64, 0, len(grams))
+	for _, g := range grams {
+		docs, ok := ix.postings[g]
+		if !ok {
+			return nil
+		}
+		lists = append(lists, docs)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	n := float64(len(ix.docs))
+	var results []Result
+	for id := range lists[0] {
+		var score float64
+		matched := true
+		for _, docs := range lists {
+			w, ok := docs[id]
+			if !ok {
+				matched = false
+				break
+			}
+			score += w * math.Log(1+n/float64(len(docs)))
+		}
+		if matched {
+			results = append(results, Result{ID: id, Score: score})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].ID > results[j].ID
+		}
+		return results[i].Score > results[j].Score
+	})
+	return results
+}
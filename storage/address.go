@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"mall/geo"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+func (l *Location) IsValid() bool {
+	if l == nil {
+		return true
+	}
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lng >= -180 && l.Lng <= 180
+}
+
+func (l Location) Point() geo.Point {
+	return geo.Point{Lat: l.Lat, Lng: l.Lng}
+}
+
+type Address struct {
+	ID         uint64    `json:"id"`
+	UserID     uint64    `json:"user_id"`
+	Label      string    `json:"label"`
+	Contact    string    `json:"contact"`
+	Phone      string    `json:"phone"`
+	Address    string    `json:"address"`
+	Location   *Location `json:"location,omitempty"`
+	CreateTime time.Time `json:"create_time"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+type AddressSlice []Address
+
+func (a AddressSlice) Len() int           { return len(a) }
+func (a AddressSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a AddressSlice) Less(i, j int) bool { return a[i].UpdateTime.Before(a[j].UpdateTime) }
+
+func (a *Address) IsValid() (bool, string) {
+	if a.ID == 0 || a.UserID == 0 {
+		return false, ""
+	}
+	if a.Address == "" {
+		return false, "地址为空"
+	}
+	if a.Phone == "" {
+		return false, "联系电话为空"
+	}
+	if !a.Location.IsValid() {
+		return false, "坐标错误"
+	}
+	return true, ""
+}
+
+func (Address) GetKey(uid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf("user/address/%d/", uid)
+	}
+	return fmt.Sprintf("user/address/%d/%d", uid, id)
+}
+
+func (a *Address) Save() error {
+	return Set(a.GetKey(a.UserID, a.ID), a)
+}
+
+func (a Address) GetByID(uid, id uint64) (Address, error) {
+	var address Address
+	err := Get(a.GetKey(uid, id), &address)
+	return address, err
+}
+
+func (a Address) GetAddresses(uid uint64) (AddressSlice, error) {
+	m, err := GetAllWithPrefix[Address](a.GetKey(uid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var addresses = make(AddressSlice, 0, len(m))
+	for _, v := range m {
+		addresses = append(addresses, v)
+	}
+	return addresses, nil
+}
+
+func (a *Address) Update(uid, id uint64) (*Address, error) {
+	var old Address
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(a.GetKey(uid, id)))
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		if a.Label != "" {
+			old.Label = a.Label
+		}
+		if a.Contact != "" {
+			old.Contact = a.Contact
+		}
+		if a.Phone != "" {
+			old.Phone = a.Phone
+		}
+		if a.Address != "" {
+			old.Address = a.Address
+		}
+		if a.Location != nil {
+			old.Location = a.Location
+		}
+		old.UpdateTime = time.Now()
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+	return &old, err
+}
+
+func (a Address) Delete(uid, id uint64) error {
+	return Delete(a.GetKey(uid, id))
+}
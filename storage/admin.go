@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type AdminAction string
+
+const (
+	GrantAdmin  AdminAction = "grant"
+	RevokeAdmin AdminAction = "revoke"
+)
+
+// AdminAudit 平台管理员变更记录
+type AdminAudit struct {
+	ID         uint64      `json:"id"`
+	UserID     uint64      `json:"user_id"`
+	OpenID     string      `json:"open_id"`
+	Action     AdminAction `json:"action"`
+	Source     string      `json:"source"` // config, cli
+	CreateTime time.Time   `json:"create_time"`
+}
+
+func (AdminAudit) GetKey(id uint64) string {
+	if id == 0 {
+		return "audit/admin/"
+	}
+	return fmt.Sprintf("audit/admin/%d", id)
+}
+
+func (a AdminAudit) GetAudits() ([]AdminAudit, error) {
+	m, err := GetAllWithPrefix[AdminAudit](a.GetKey(0))
+	if err != nil {
+		return nil, err
+	}
+	var audits = make([]AdminAudit, 0, len(m))
+	for _, v := range m {
+		audits = append(audits, v)
+	}
+	return audits, nil
+}
+
+// SetAdmin 授予或撤销平台管理员. 用户还没登录过时先创建用户, 登录后沿用.
+// 角色没有变化时不记录, 返回 false
+func SetAdmin(openid string, action AdminAction, source string) (bool, error) {
+	if openid == "" {
+		return false, errors.New("openid is empty")
+	}
+	kind := Customer
+	if action == GrantAdmin {
+		kind = Admin
+	}
+	var u User
+	var changed bool
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		var now = time.Now()
+		var user User
+		item, err := txn.Get([]byte(u.GetOpenKey(openid)))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			if action == RevokeAdmin {
+				return nil
+			}
+			id, err := GenID()
+			if err != nil {
+				return err
+			}
+			user = User{ID: id, OpenID: openid, Kind: Customer, CreateTime: now}
+			data, _ := json.Marshal(id)
+			err = txn.Set([]byte(u.GetOpenKey(openid)), data)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			var id uint64
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &id)
+			})
+			if err != nil {
+				return err
+			}
+			item, err = txn.Get([]byte(u.GetKey(id)))
+			if err != nil {
+				return err
+			}
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &user)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if user.Kind == kind {
+			return nil
+		}
+		user.Kind = kind
+		user.UpdateTime = now
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(u.GetKey(user.ID)), data)
+		if err != nil {
+			return err
+		}
+
+		id, err := GenID()
+		if err != nil {
+			return err
+		}
+		audit := AdminAudit{
+			ID:         id,
+			UserID:     user.ID,
+			OpenID:     openid,
+			Action:     action,
+			Source:     source,
+			CreateTime: now,
+		}
+		data, err = json.Marshal(audit)
+		if err != nil {
+			return err
+		}
+		changed = true
+		return txn.Set([]byte(audit.GetKey(id)), data)
+	})
+	if changed {
+		logrus.Infof("%s admin openid:%s by %s", action, openid, source)
+	}
+	return changed, err
+}
+
+// GrantAdmins 启动时授予配置中的平台管理员, 不会撤销不在配置中的管理员
+func GrantAdmins(openids []string, source string) error {
+	for _, openid := range openids {
+		if _, err := SetAdmin(openid, GrantAdmin, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u User) GetAdmins() ([]User, error) {
+	users, err := u.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+	var admins []User
+	for _, v := range users {
+		if v.Kind == Admin {
+			admins = append(admins, v)
+		}
+	}
+	return admins, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mall/set"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var ErrAPIKeyInvalid = errors.New("api key invalid")
+
+// 使用时间最多每分钟写一次
+const apiKeyTouchInterval = time.Minute
+
+// APIKey 租户后台系统集成使用的密钥, 库中只保存哈希, 明文只在创建时返回一次
+type APIKey struct {
+	ID           uint64       `json:"id"`
+	LesseeID     uint64       `json:"lessee_id"`
+	Name         string       `json:"name"`
+	Prefix       string       `json:"prefix"` // 明文的前几位, 用于区分密钥
+	KeyHash      string       `json:"key_hash,omitempty"`
+	Permissions  []Permission `json:"permissions"`
+	CreatorID    uint64       `json:"creator_id"`
+	ExpireTime   time.Time    `json:"expire_time"` // 零值表示不过期
+	LastUsedTime time.Time    `json:"last_used_time"`
+	CreateTime   time.Time    `json:"create_time"`
+}
+
+// 按哈希查找密钥
+type apiKeyRef struct {
+	LesseeID uint64 `json:"lessee_id"`
+	ID       uint64 `json:"id"`
+}
+
+func (k *APIKey) IsValid() (bool, string) {
+	if k.LesseeID == 0 {
+		return false, "非法租户"
+	}
+	if k.Name == "" {
+		return false, "名称为空"
+	}
+	if len(k.Permissions) == 0 {
+		return false, "权限为空"
+	}
+	allowed := set.From(LesseePermissions)
+	for _, p := range k.Permissions {
+		if !allowed.Has(p) {
+			return false, fmt.Sprintf("权限错误:%s", p)
+		}
+	}
+	if !k.ExpireTime.IsZero() && k.ExpireTime.Before(time.Now()) {
+		return false, "过期时间错误"
+	}
+	return true, ""
+}
+
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpireTime.IsZero() && now.After(k.ExpireTime)
+}
+
+func (k APIKey) HasPermission(perm Permission) bool {
+	return set.From(k.Permissions).Has(perm)
+}
+
+func (APIKey) GetKey(lid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf("apikey/lessee/%d/", lid)
+	}
+	return fmt.Sprintf("apikey/lessee/%d/%d", lid, id)
+}
+
+func (APIKey) getHashKey(hash string) string {
+	return fmt.Sprintf("apikey/hash/%s", hash)
+}
+
+// CreateAPIKey 生成密钥并保存, 返回明文
+func CreateAPIKey(k *APIKey) (string, error) {
+	id, err := GenID()
+	if err != nil {
+		return "", err
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	key := "mk_" + token
+	k.ID = id
+	k.Prefix = key[:10]
+	k.KeyHash = hashToken(key)
+	k.CreateTime = time.Now()
+
+	err = GetDB().Update(func(txn *badger.Txn) error {
+		data, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(k.GetKey(k.LesseeID, k.ID)), data)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(apiKeyRef{LesseeID: k.LesseeID, ID: k.ID})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(k.getHashKey(k.KeyHash)), data)
+	})
+	return key, err
+}
+
+// AuthAPIKey 校验明文密钥, 过期或已撤销时返回 ErrAPIKeyInvalid, 并记录使用时间
+func AuthAPIKey(key string) (APIKey, error) {
+	var m APIKey
+	var ref apiKeyRef
+	err := Get(m.getHashKey(hashToken(key)), &ref)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	k, err := m.Get(ref.LesseeID, ref.ID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var now = time.Now()
+	if k.Expired(now) {
+		return APIKey{}, ErrAPIKeyInvalid
+	}
+	if now.Sub(k.LastUsedTime) > apiKeyTouchInterval {
+		err = touchAPIKey(k.LesseeID, k.ID, now)
+		if err != nil {
+			return APIKey{}, err
+		}
+		k.LastUsedTime = now
+	}
+	return k, nil
+}
+
+// touchAPIKey 在事务中重新读取后写入使用时间, 校验后被撤销的密钥不会被写回
+func touchAPIKey(lid, id uint64, now time.Time) error {
+	key := []byte(APIKey{}.GetKey(lid, id))
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		var k APIKey
+		err = json.Unmarshal(data, &k)
+		if err != nil {
+			return err
+		}
+		if k.Expired(now) {
+			return ErrAPIKeyInvalid
+		}
+		k.LastUsedTime = now
+		data, err = json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, data)
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return ErrAPIKeyInvalid
+	}
+	// 同时有其他请求写入或撤销, 使用时间只是参考, 不影响本次校验
+	if errors.Is(err, badger.ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+func (m APIKey) Get(lid, id uint64) (APIKey, error) {
+	var k APIKey
+	err := Get(m.GetKey(lid, id), &k)
+	return k, err
+}
+
+func (m APIKey) GetByLessee(lid uint64) ([]APIKey, error) {
+	mm, err := GetAllWithPrefix[APIKey](m.GetKey(lid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var keys = make([]APIKey, 0, len(mm))
+	for _, v := range mm {
+		keys = append(keys, v)
+	}
+	return keys, nil
+}
+
+// Delete 撤销密钥, 立即失效
+func (m APIKey) Delete(lid, id uint64) error {
+	k, err := m.Get(lid, id)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return deleteAPIKey(txn, &k)
+	})
+}
+
+func (m APIKey) DeleteByLessee(lid uint64) error {
+	keys, err := m.GetByLessee(lid)
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for i := range keys {
+			if err := deleteAPIKey(txn, &keys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func deleteAPIKey(txn *badger.Txn, k *APIKey) error {
+	err := txn.Delete([]byte(k.GetKey(k.LesseeID, k.ID)))
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(k.getHashKey(k.KeyHash)))
+}
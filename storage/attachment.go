@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type AttachmentKind string
+
+const (
+	BeforeService AttachmentKind = "before"
+	AfterService  AttachmentKind = "after"
+	Signature     AttachmentKind = "signature"
+)
+
+func (k AttachmentKind) IsValid() bool {
+	switch k {
+	case BeforeService:
+	case AfterService:
+	case Signature:
+	default:
+		return false
+	}
+	return true
+}
+
+type OrderAttachment struct {
+	ID         uint64         `json:"id"`
+	LesseeID   uint64         `json:"lessee_id"`
+	OrderID    uint64         `json:"order_id"`
+	Kind       AttachmentKind `json:"kind"`
+	User       SimpleUser     `json:"user"`
+	Remark     string         `json:"remark"`
+	Path       string         `json:"path"`            // 需要鉴权的访问地址
+	Image      string         `json:"image,omitempty"` // 按内容存储的图片 key, 不返回给客户端
+	CreateTime time.Time      `json:"create_time"`
+}
+
+type OrderAttachmentSlice []OrderAttachment
+
+func (a OrderAttachmentSlice) Len() int           { return len(a) }
+func (a OrderAttachmentSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a OrderAttachmentSlice) Less(i, j int) bool { return a[i].CreateTime.Before(a[j].CreateTime) }
+
+// 附件记录的前缀, 也是附件图片引用的 owner 前缀
+const attachmentKeyPrefix = "order/attachment/"
+
+func (OrderAttachment) GetKey(lid, oid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf(attachmentKeyPrefix+"%d/%d/", lid, oid)
+	}
+	return fmt.Sprintf(attachmentKeyPrefix+"%d/%d/%d", lid, oid, id)
+}
+
+// getLegacyAttachmentImageKey 旧版本按订单存储的附件图片, 只用于迁移
+func getLegacyAttachmentImageKey(lid, oid, id uint64) string {
+	return fmt.Sprintf("img/order/%d/%d/%d", lid, oid, id)
+}
+
+// Save 图片已按内容保存在 a.Image, 附件记录引用, 删除附件后由 GC 回收
+func (a *OrderAttachment) Save() error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return setAttachment(txn, a)
+	})
+}
+
+func setAttachment(txn *badger.Txn, a *OrderAttachment) error {
+	key := a.GetKey(a.LesseeID, a.OrderID, a.ID)
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	err = txn.Set([]byte(key), data)
+	if err != nil {
+		return err
+	}
+	return setImageRefs(txn, key, nil, []string{"/" + a.Image})
+}
+
+func deleteAttachment(txn *badger.Txn, a *OrderAttachment) error {
+	key := a.GetKey(a.LesseeID, a.OrderID, a.ID)
+	err := txn.Delete([]byte(key))
+	if err != nil {
+		return err
+	}
+	return setImageRefs(txn, key, []string{"/" + a.Image}, nil)
+}
+
+func (a OrderAttachment) GetByID(lid, oid, id uint64) (OrderAttachment, error) {
+	var attachment OrderAttachment
+	err := Get(a.GetKey(lid, oid, id), &attachment)
+	return attachment, err
+}
+
+func (a OrderAttachment) GetAttachments(lid, oid uint64) (OrderAttachmentSlice, error) {
+	m, err := GetAllWithPrefix[OrderAttachment](a.GetKey(lid, oid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var attachments = make(OrderAttachmentSlice, 0, len(m))
+	for _, v := range m {
+		attachments = append(attachments, v)
+	}
+	return attachments, nil
+}
+
+func (a OrderAttachment) Delete(lid, oid, id uint64) error {
+	attachment, err := a.GetByID(lid, oid, id)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return deleteAttachment(txn, &attachment)
+	})
+}
+
+func (a OrderAttachment) DeleteByOrder(lid, oid uint64) error {
+	attachments, err := a.GetAttachments(lid, oid)
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for i := range attachments {
+			if err := deleteAttachment(txn, &attachments[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
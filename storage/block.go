@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type BlockKind string
+
+const (
+	BlockUser  BlockKind = "user"
+	BlockPhone BlockKind = "phone"
+)
+
+// Block 租户黑名单, 按用户或手机号限制下单和申请加入. 有过期时间的到期后自动删除
+type Block struct {
+	LesseeID   uint64    `json:"lessee_id"`
+	Kind       BlockKind `json:"kind"`
+	Target     string    `json:"target"` // 用户 id 或手机号
+	Reason     string    `json:"reason"`
+	CreatorID  uint64    `json:"creator_id"`
+	ExpireTime time.Time `json:"expire_time"` // 零值表示永久
+	CreateTime time.Time `json:"create_time"`
+}
+
+// NormalizePhone 去掉空格、横线和 +86 国家码, 黑名单和订单中的手机号按同一格式比较
+func NormalizePhone(phone string) string {
+	phone = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' {
+			return -1
+		}
+		return r
+	}, phone)
+	for _, prefix := range []string{"+86", "0086"} {
+		if p, ok := strings.CutPrefix(phone, prefix); ok {
+			return p
+		}
+	}
+	return phone
+}
+
+func (b *Block) IsValid() (bool, string) {
+	if b.LesseeID == 0 {
+		return false, "非法租户"
+	}
+	b.Target = strings.TrimSpace(b.Target)
+	if b.Kind == BlockPhone {
+		b.Target = NormalizePhone(b.Target)
+	}
+	switch b.Kind {
+	case BlockUser, BlockPhone:
+	default:
+		return false, "类型错误"
+	}
+	if b.Target == "" || b.Target == "0" {
+		return false, "用户或手机号为空"
+	}
+	if b.Reason == "" {
+		return false, "请填写原因"
+	}
+	if !b.ExpireTime.IsZero() && b.ExpireTime.Before(time.Now()) {
+		return false, "过期时间错误"
+	}
+	return true, ""
+}
+
+func (Block) GetKey(lid uint64, kind BlockKind, target string) string {
+	if kind == "" {
+		return fmt.Sprintf("block/lessee/%d/", lid)
+	}
+	return fmt.Sprintf("block/lessee/%d/%s/%s", lid, kind, target)
+}
+
+func (b *Block) Save() error {
+	var ttl time.Duration
+	if !b.ExpireTime.IsZero() {
+		ttl = time.Until(b.ExpireTime)
+	}
+	return Set(b.GetKey(b.LesseeID, b.Kind, b.Target), b, ttl)
+}
+
+func (b Block) Get(lid uint64, kind BlockKind, target string) (Block, error) {
+	var block Block
+	err := Get(b.GetKey(lid, kind, target), &block)
+	return block, err
+}
+
+// Check 用户或任一手机号在租户黑名单中时返回对应记录
+func (b Block) Check(lid, uid uint64, phones ...string) (Block, bool, error) {
+	var keys = []string{b.GetKey(lid, BlockUser, fmt.Sprint(uid))}
+	for _, phone := range phones {
+		if phone = NormalizePhone(phone); phone != "" {
+			keys = append(keys, b.GetKey(lid, BlockPhone, phone))
+		}
+	}
+	for _, key := range keys {
+		var block Block
+		err := Get(key, &block)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return Block{}, false, err
+		}
+		return block, true, nil
+	}
+	return Block{}, false, nil
+}
+
+func (b Block) GetByLessee(lid uint64) ([]Block, error) {
+	m, err := GetAllWithPrefix[Block](b.GetKey(lid, "", ""))
+	if err != nil {
+		return nil, err
+	}
+	var blocks = make([]Block, 0, len(m))
+	for _, v := range m {
+		blocks = append(blocks, v)
+	}
+	return blocks, nil
+}
+
+func (b Block) Delete(lid uint64, kind BlockKind, target string) error {
+	if kind == BlockPhone {
+		target = NormalizePhone(target)
+	}
+	return Delete(b.GetKey(lid, kind, target))
+}
+
+func (b Block) DeleteByLessee(lid uint64) error {
+	return DeleteAllWithPrefix(b.GetKey(lid, "", ""))
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"mall/set"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type Category struct {
+	ID         uint64    `json:"id"`
+	LesseeID   uint64    `json:"lessee_id"`
+	ParentID   uint64    `json:"parent_id"`
+	Name       string    `json:"name"`
+	Icon       string    `json:"icon"`
+	Sort       int       `json:"sort"`
+	CreateTime time.Time `json:"create_time"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+// CategorySlice 按 Sort 升序, 相同时按创建时间
+type CategorySlice []Category
+
+func (a CategorySlice) Len() int      { return len(a) }
+func (a CategorySlice) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a CategorySlice) Less(i, j int) bool {
+	if a[i].Sort == a[j].Sort {
+		return a[i].CreateTime.Before(a[j].CreateTime)
+	}
+	return a[i].Sort < a[j].Sort
+}
+
+// Descendants 返回 id 及其所有子孙分类
+func (a CategorySlice) Descendants(id uint64) *set.Set[uint64] {
+	children := make(map[uint64][]uint64, len(a))
+	for _, v := range a {
+		children[v.ParentID] = append(children[v.ParentID], v.ID)
+	}
+	ids := set.New[uint64]()
+	queue := []uint64{id}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if ids.Has(cur) {
+			continue
+		}
+		ids.Add(cur)
+		queue = append(queue, children[cur]...)
+	}
+	return ids
+}
+
+func (c *Category) IsValid() (bool, string) {
+	if c.ID == 0 {
+		logrus.Errorln("category id is 0")
+		return false, ""
+	}
+	if c.LesseeID == 0 {
+		return false, "非法租户"
+	}
+	if c.Name == "" {
+		return false, "分类名为空"
+	}
+	if c.ParentID == c.ID {
+		return false, "上级分类错误"
+	}
+	return true, ""
+}
+
+func (Category) GetKey(lid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf("category/%d/", lid)
+	}
+	return fmt.Sprintf("category/%d/%d", lid, id)
+}
+
+func (c *Category) Save() error {
+	key := c.GetKey(c.LesseeID, c.ID)
+	return GetDB().Update(func(txn *badger.Txn) error {
+		err := setImageRefs(txn, key, nil, []string{c.Icon})
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(key), data)
+	})
+}
+
+func (c Category) GetByID(lid, id uint64) (Category, error) {
+	var category Category
+	err := Get(c.GetKey(lid, id), &category)
+	return category, err
+}
+
+func (c Category) GetCategories(lid uint64) (CategorySlice, error) {
+	m, err := GetAllWithPrefix[Category](c.GetKey(lid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var categories = make(CategorySlice, 0, len(m))
+	for _, v := range m {
+		categories = append(categories, v)
+	}
+	return categories, nil
+}
+
+func (c *Category) Update(lid, id uint64) (*Category, error) {
+	var old Category
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(c.GetKey(lid, id)))
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		if c.Name != "" {
+			old.Name = c.Name
+		}
+		if c.Icon != "" {
+			err = setImageRefs(txn, string(item.KeyCopy(nil)), []string{old.Icon}, []string{c.Icon})
+			if err != nil {
+				return err
+			}
+			old.Icon = c.Icon
+		}
+		old.ParentID = c.ParentID
+		old.Sort = c.Sort
+		old.UpdateTime = time.Now()
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+	return &old, err
+}
+
+func (c Category) Delete(lid, id uint64) error {
+	key := c.GetKey(lid, id)
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		var old Category
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		err = setImageRefs(txn, key, []string{old.Icon}, nil)
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	return Model[Goods]().RemoveCategory(lid, id)
+}
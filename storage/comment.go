@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mall/set"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type OrderComment struct {
+	ID         uint64     `json:"id"`
+	LesseeID   uint64     `json:"lessee_id"`
+	OrderID    uint64     `json:"order_id"`
+	User       SimpleUser `json:"user"`
+	Content    string     `json:"content"`
+	Images     []string   `json:"images"`
+	CreateTime time.Time  `json:"create_time"`
+}
+
+type OrderCommentSlice []OrderComment
+
+func (a OrderCommentSlice) Len() int           { return len(a) }
+func (a OrderCommentSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a OrderCommentSlice) Less(i, j int) bool { return a[i].CreateTime.Before(a[j].CreateTime) }
+
+func (c *OrderComment) IsValid() (bool, string) {
+	if c.ID == 0 || c.OrderID == 0 {
+		return false, ""
+	}
+	if c.LesseeID == 0 {
+		return false, "非法租户"
+	}
+	if c.User.ID == 0 {
+		return false, "用户为空"
+	}
+	if c.Content == "" && len(c.Images) == 0 {
+		return false, "留言内容为空"
+	}
+	if len(c.Images) > 9 {
+		return false, "图片最多9张"
+	}
+	return true, ""
+}
+
+func (OrderComment) GetKey(lid, oid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf("order/comment/%d/%d/", lid, oid)
+	}
+	return fmt.Sprintf("order/comment/%d/%d/%d", lid, oid, id)
+}
+
+// GetUnreadKey 用户未读留言计数, 前缀为 uid 便于列出该用户所有未读
+func (OrderComment) GetUnreadKey(uid, lid, oid uint64) string {
+	if oid == 0 {
+		return fmt.Sprintf("order/unread/%d/%d/", uid, lid)
+	}
+	return fmt.Sprintf("order/unread/%d/%d/%d", uid, lid, oid)
+}
+
+// Save 保存留言, 并给除作者外的参与人未读数加一
+func (c *OrderComment) Save(readers []uint64) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		key := c.GetKey(c.LesseeID, c.OrderID, c.ID)
+		err = txn.Set([]byte(key), data)
+		if err != nil {
+			return err
+		}
+		err = setImageRefs(txn, key, nil, c.Images)
+		if err != nil {
+			return err
+		}
+		for _, uid := range readers {
+			if uid == c.User.ID {
+				continue
+			}
+			key := []byte(c.GetUnreadKey(uid, c.LesseeID, c.OrderID))
+			var count int
+			item, err := txn.Get(key)
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if err == nil {
+				data, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				err = json.Unmarshal(data, &count)
+				if err != nil {
+					return err
+				}
+			}
+			data, _ := json.Marshal(count + 1)
+			err = txn.Set(key, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c OrderComment) GetComments(lid, oid uint64) (OrderCommentSlice, error) {
+	m, err := GetAllWithPrefix[OrderComment](c.GetKey(lid, oid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var comments = make(OrderCommentSlice, 0, len(m))
+	for _, v := range m {
+		comments = append(comments, v)
+	}
+	return comments, nil
+}
+
+func (c OrderComment) GetByID(lid, oid, id uint64) (OrderComment, error) {
+	var comment OrderComment
+	err := Get(c.GetKey(lid, oid, id), &comment)
+	return comment, err
+}
+
+func (c OrderComment) Delete(lid, oid, id uint64) error {
+	comment, err := c.GetByID(lid, oid, id)
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return comment.delete(txn)
+	})
+}
+
+func (c *OrderComment) delete(txn *badger.Txn) error {
+	key := c.GetKey(c.LesseeID, c.OrderID, c.ID)
+	err := setImageRefs(txn, key, c.Images, nil)
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(key))
+}
+
+// DeleteByOrder 删除订单的留言和参与人的未读数, 留言作者也可能已经不是参与人, 一并清理
+func (c OrderComment) DeleteByOrder(lid, oid uint64, readers []uint64) error {
+	comments, err := c.GetComments(lid, oid)
+	if err != nil {
+		return err
+	}
+	uids := set.From(readers)
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for i := range comments {
+			err := comments[i].delete(txn)
+			if err != nil {
+				return err
+			}
+			uids.Add(comments[i].User.ID)
+		}
+		for _, uid := range uids.ToSlice() {
+			err := txn.Delete([]byte(c.GetUnreadKey(uid, lid, oid)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUnread 获取用户在某租户下每个订单的未读数
+func (c OrderComment) GetUnread(uid, lid uint64) (map[uint64]int, error) {
+	prefix := c.GetUnreadKey(uid, lid, 0)
+	m, err := GetAllWithPrefix[int](prefix)
+	if err != nil {
+		return nil, err
+	}
+	var unread = make(map[uint64]int, len(m))
+	for k, v := range m {
+		var oid uint64
+		_, err := fmt.Sscanf(k[len(prefix):], "%d", &oid)
+		if err != nil || v == 0 {
+			continue
+		}
+		unread[oid] = v
+	}
+	return unread, nil
+}
+
+func (c OrderComment) ClearUnread(uid, lid, oid uint64) error {
+	return Delete(c.GetUnreadKey(uid, lid, oid))
+}
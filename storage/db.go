@@ -28,15 +28,37 @@ func Init(dbpath string) error {
 		return err
 	}
 
+	err = migrateImageBlobs()
+	if err != nil {
+		return err
+	}
+	err = migrateAttachmentBlobs()
+	if err != nil {
+		return err
+	}
+	err = migrateMembers()
+	if err != nil {
+		return err
+	}
+	err = buildGoodsIndex()
+	if err != nil {
+		return err
+	}
+
 	go func() {
 		defer seq.Release()
 		tk := time.NewTicker(10 * time.Minute)
+		imgTk := time.NewTicker(time.Hour)
 		for {
 			select {
 			// case <-cmd.Context().Done():
 			// 	return
 			case <-tk.C:
 				db.RunValueLogGC(0.5)
+			case <-imgTk.C:
+				if _, err := GCImages(ImageGCGrace); err != nil {
+					logrus.Errorf("image gc error:%v", err)
+				}
 			}
 		}
 	}()
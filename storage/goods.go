@@ -2,7 +2,11 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mall/set"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -10,18 +14,52 @@ import (
 )
 
 type Goods struct {
-	ID         uint64      `json:"id"`
-	LesseeID   uint64      `json:"lessee_id"`
-	Status     GoodsStatus `json:"status"`
-	Name       string      `json:"name"`
-	FinalPrice float64     `json:"final_price"`
-	Price      float64     `json:"price"`
-	Tags       []string    `json:"tags"`
-	Avatar     string      `json:"avatar"`
-	Sold       uint64      `json:"sold"`
-	CreateTime time.Time   `json:"create_time"`
-	UpdateTime time.Time   `json:"update_time"`
+	ID              uint64        `json:"id"`
+	LesseeID        uint64        `json:"lessee_id"`
+	Code            string        `json:"code"` // 商户自己的商品编码, 导入时按编码更新
+	Status          GoodsStatus   `json:"status"`
+	Name            string        `json:"name"`
+	FinalPrice      float64       `json:"final_price"`
+	Price           float64       `json:"price"`
+	Tags            []string      `json:"tags"`
+	Categories      []uint64      `json:"categories"`
+	Options         []GoodsOption `json:"options"`
+	Skus            []Sku         `json:"skus"`
+	Avatar          string        `json:"avatar"`
+	Images          []string      `json:"images"`      // 图集, 按展示顺序
+	Description     string        `json:"description"` // markdown
+	DescriptionHTML string        `json:"description_html"`
+	Sold            uint64        `json:"sold"`
+	Sort            int           `json:"sort"`   // 手动排序, 越小越靠前
+	Pinned          bool          `json:"pinned"` // 置顶推荐, 任何排序下都排在最前
+	PriceRules      []PriceRule   `json:"price_rules"`
+	Sale            *PriceRule    `json:"sale,omitempty"` // 生效中的活动, 只在返回时填充
+	CreateTime      time.Time     `json:"create_time"`
+	UpdateTime      time.Time     `json:"update_time"`
 }
+
+// GoodsOption 规格维度, 如 面积: [小, 中, 大]
+type GoodsOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// Sku 规格组合, Values 与 Goods.Options 按顺序一一对应
+type Sku struct {
+	ID         uint64   `json:"id"`
+	Values     []string `json:"values"`
+	Price      float64  `json:"price"`
+	FinalPrice float64  `json:"final_price"`
+	Stock      int      `json:"stock"`
+	Sold       uint64   `json:"sold"`
+}
+
+func (s *Sku) Name() string {
+	return strings.Join(s.Values, "/")
+}
+
+var ErrOutOfStock = errors.New("out of stock")
+
 type GoodsStatus string
 
 const (
@@ -35,6 +73,67 @@ func (a GoodsSlice) Len() int           { return len(a) }
 func (a GoodsSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a GoodsSlice) Less(i, j int) bool { return a[i].UpdateTime.Before(a[j].UpdateTime) }
 
+type GoodsSort string
+
+const (
+	SortByUpdate    GoodsSort = ""           // 最近更新, 默认
+	SortByNewest    GoodsSort = "newest"     // 最新上架
+	SortBySold      GoodsSort = "sold"       // 销量从高到低
+	SortByPriceAsc  GoodsSort = "price_asc"  // 价格从低到高
+	SortByPriceDesc GoodsSort = "price_desc" // 价格从高到低
+	SortByManual    GoodsSort = "manual"     // 管理员设置的顺序
+)
+
+func (s GoodsSort) IsValid() bool {
+	switch s {
+	case SortByUpdate:
+	case SortByNewest:
+	case SortBySold:
+	case SortByPriceAsc:
+	case SortByPriceDesc:
+	case SortByManual:
+	default:
+		return false
+	}
+	return true
+}
+
+// SortBy 置顶商品在前, 其余按 by 排序, 相同时按更新时间倒序保证顺序稳定
+func (a GoodsSlice) SortBy(by GoodsSort) {
+	sort.SliceStable(a, func(i, j int) bool {
+		x, y := &a[i], &a[j]
+		if x.Pinned != y.Pinned {
+			return x.Pinned
+		}
+		switch by {
+		case SortByNewest:
+			if !x.CreateTime.Equal(y.CreateTime) {
+				return x.CreateTime.After(y.CreateTime)
+			}
+		case SortBySold:
+			if x.Sold != y.Sold {
+				return x.Sold > y.Sold
+			}
+		case SortByPriceAsc:
+			if x.FinalPrice != y.FinalPrice {
+				return x.FinalPrice < y.FinalPrice
+			}
+		case SortByPriceDesc:
+			if x.FinalPrice != y.FinalPrice {
+				return x.FinalPrice > y.FinalPrice
+			}
+		case SortByManual:
+			if x.Sort != y.Sort {
+				return x.Sort < y.Sort
+			}
+		}
+		if !x.UpdateTime.Equal(y.UpdateTime) {
+			return x.UpdateTime.After(y.UpdateTime)
+		}
+		return x.ID > y.ID
+	})
+}
+
 func (g *Goods) IsValid() (bool, string) {
 	if g.ID == 0 {
 		logrus.Errorln("goods id is 0")
@@ -55,17 +154,127 @@ func (g *Goods) IsValid() (bool, string) {
 	if g.FinalPrice > g.Price {
 		return false, "折后价需小于原价"
 	}
+	return g.IsSkusValid()
+}
+
+func (g *Goods) IsSkusValid() (bool, string) {
+	if len(g.Skus) == 0 {
+		return true, ""
+	}
+	if len(g.Options) == 0 {
+		return false, "规格为空"
+	}
+	var options = make([]*set.Set[string], 0, len(g.Options))
+	for _, o := range g.Options {
+		if o.Name == "" || len(o.Values) == 0 {
+			return false, "规格为空"
+		}
+		options = append(options, set.From(o.Values))
+	}
+	var names = set.New[string](len(g.Skus))
+	for i := range g.Skus {
+		sku := &g.Skus[i]
+		if sku.ID == 0 {
+			logrus.Errorln("sku id is 0")
+			return false, ""
+		}
+		if len(sku.Values) != len(options) {
+			return false, "规格组合错误"
+		}
+		for j, v := range sku.Values {
+			if !options[j].Has(v) {
+				return false, "规格组合错误"
+			}
+		}
+		if names.Has(sku.Name()) {
+			return false, "规格组合重复"
+		}
+		names.Add(sku.Name())
+		if sku.FinalPrice <= 0 || sku.Price <= 0 {
+			return false, "规格价格为空"
+		}
+		if sku.FinalPrice > sku.Price {
+			return false, "折后价需小于原价"
+		}
+		if sku.Stock < 0 {
+			return false, "库存错误"
+		}
+	}
 	return true, ""
 }
 
+// SyncSkuPrice 有规格时商品价格展示为最低规格价
+func (g *Goods) SyncSkuPrice() {
+	for i, sku := range g.Skus {
+		if i == 0 || sku.FinalPrice < g.FinalPrice {
+			g.FinalPrice = sku.FinalPrice
+			g.Price = sku.Price
+		}
+	}
+}
+
+func (g *Goods) GetSku(id uint64) (*Sku, bool) {
+	for i := range g.Skus {
+		if g.Skus[i].ID == id {
+			return &g.Skus[i], true
+		}
+	}
+	return nil, false
+}
+
 func (Goods) GetKey(lid, id uint64) string {
 	if id == 0 {
 		return fmt.Sprintf("goods/%d/", lid)
 	}
 	return fmt.Sprintf("goods/%d/%d", lid, id)
 }
+
+// imagePaths 商品引用的图片, 用于图片引用计数
+func (g *Goods) imagePaths() []string {
+	return append([]string{g.Avatar}, g.Images...)
+}
+
 func (g *Goods) Save() error {
-	return Set(g.GetKey(g.LesseeID, g.ID), g)
+	g.DescriptionHTML = renderMarkdown(g.Description)
+	key := g.GetKey(g.LesseeID, g.ID)
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		var old *Goods
+		item, err := txn.Get([]byte(key))
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		if err == nil {
+			old = &Goods{}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(data, old)
+			if err != nil {
+				return err
+			}
+			err = setImageRefs(txn, key, old.imagePaths(), g.imagePaths())
+		} else {
+			err = setImageRefs(txn, key, nil, g.imagePaths())
+		}
+		if err != nil {
+			return err
+		}
+		err = addPriceChanges(txn, old, g)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(key), data)
+	})
+	if err != nil {
+		return err
+	}
+	indexGoods(g)
+	return nil
 }
 
 func (g Goods) GetGoods(lid uint64) (GoodsSlice, error) {
@@ -81,6 +290,20 @@ func (g Goods) GetGoods(lid uint64) (GoodsSlice, error) {
 	return goods, nil
 }
 
+// GetByCode 按商品编码查找, 没有时返回 badger.ErrKeyNotFound
+func (g Goods) GetByCode(lid uint64, code string) (Goods, error) {
+	goods, err := g.GetGoods(lid)
+	if err != nil {
+		return Goods{}, err
+	}
+	for _, v := range goods {
+		if v.Code == code {
+			return v, nil
+		}
+	}
+	return Goods{}, badger.ErrKeyNotFound
+}
+
 func (g Goods) GetByID(lid, id uint64) (Goods, error) {
 	key := g.GetKey(lid, id)
 	var goods Goods
@@ -88,13 +311,14 @@ func (g Goods) GetByID(lid, id uint64) (Goods, error) {
 	return goods, err
 }
 
-func (g *Goods) Update(lid, id uint64) error {
-	return GetDB().Update(func(txn *badger.Txn) error {
+// Update 空字段保留原值, description 为 nil 时不修改描述, 为空字符串时清空
+func (g *Goods) Update(lid, id uint64, description *string) error {
+	var old Goods
+	err := GetDB().Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(g.GetKey(lid, id)))
 		if err != nil {
 			return err
 		}
-		var old Goods
 		data, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
@@ -103,9 +327,13 @@ func (g *Goods) Update(lid, id uint64) error {
 		if err != nil {
 			return err
 		}
+		before := old
 		if g.Name != "" {
 			old.Name = g.Name
 		}
+		if g.Code != "" {
+			old.Code = g.Code
+		}
 		if g.FinalPrice != 0 {
 			old.FinalPrice = g.FinalPrice
 		}
@@ -115,10 +343,42 @@ func (g *Goods) Update(lid, id uint64) error {
 		if len(g.Tags) > 0 {
 			old.Tags = g.Tags
 		}
+		if g.Categories != nil {
+			old.Categories = g.Categories
+		}
+		if description != nil {
+			old.Description = *description
+			old.DescriptionHTML = ""
+			if old.Description != "" {
+				old.DescriptionHTML = renderMarkdown(old.Description)
+			}
+		}
+		if g.Avatar != "" && g.Avatar != old.Avatar {
+			err = setImageRefs(txn, string(item.KeyCopy(nil)), old.imagePaths(), append([]string{g.Avatar}, old.Images...))
+			if err != nil {
+				return err
+			}
+			old.Avatar = g.Avatar
+		}
+		if g.Skus != nil {
+			// 保留已有规格的销量
+			for i := range g.Skus {
+				if sku, ok := old.GetSku(g.Skus[i].ID); ok {
+					g.Skus[i].Sold = sku.Sold
+				}
+			}
+			old.Options = g.Options
+			old.Skus = g.Skus
+		}
+		old.SyncSkuPrice()
 		if g.Status != old.Status {
 			old.Status = g.Status
 		}
 		old.UpdateTime = time.Now()
+		err = addPriceChanges(txn, &before, &old)
+		if err != nil {
+			return err
+		}
 
 		data, err = json.Marshal(old)
 		if err != nil {
@@ -126,10 +386,73 @@ func (g *Goods) Update(lid, id uint64) error {
 		}
 		return txn.Set(item.KeyCopy(nil), data)
 	})
+	if err != nil {
+		return err
+	}
+	indexGoods(&old)
+	return nil
 }
 
-func (g Goods) UpdateSold(lid, id uint64, inc uint64) error {
-	return GetDB().Update(func(txn *badger.Txn) error {
+// updateSold 在下单事务中更新销量、规格库存和活动限量, inc 为负时回退
+func (g Goods) updateSold(txn *badger.Txn, lid, id, skuID, ruleID uint64, inc int) error {
+	item, err := txn.Get([]byte(g.GetKey(lid, id)))
+	if err != nil {
+		return err
+	}
+	var old Goods
+	data, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &old)
+	if err != nil {
+		return err
+	}
+
+	if skuID != 0 {
+		sku, ok := old.GetSku(skuID)
+		// 下单后规格被删除, 回退时跳过规格, 商品销量和活动限量照常回退
+		if !ok && inc > 0 {
+			return badger.ErrKeyNotFound
+		}
+		if ok {
+			if inc > 0 && sku.Stock < inc {
+				return ErrOutOfStock
+			}
+			sku.Stock -= inc
+			sku.Sold = addSold(sku.Sold, inc)
+		}
+	}
+	if ruleID != 0 {
+		rule, ok := old.getPriceRule(ruleID)
+		if inc > 0 && (!ok || !rule.ActiveAt(time.Now()) || (rule.Limit > 0 && rule.Remain() < inc)) {
+			return ErrPriceChanged
+		}
+		if ok {
+			rule.Sold = max(rule.Sold+inc, 0)
+		}
+	}
+	old.Sold = addSold(old.Sold, inc)
+	old.UpdateTime = time.Now()
+
+	data, err = json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	return txn.Set(item.KeyCopy(nil), data)
+}
+
+func addSold(sold uint64, inc int) uint64 {
+	if inc < 0 && uint64(-inc) > sold {
+		return 0
+	}
+	return uint64(int64(sold) + int64(inc))
+}
+
+// UpdateImages 修改图集, f 返回新的图集顺序
+func (g Goods) UpdateImages(lid, id uint64, f func(images []string) ([]string, error)) ([]string, error) {
+	var images []string
+	err := GetDB().Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(g.GetKey(lid, id)))
 		if err != nil {
 			return err
@@ -144,7 +467,16 @@ func (g Goods) UpdateSold(lid, id uint64, inc uint64) error {
 			return err
 		}
 
-		old.Sold += inc
+		images, err = f(old.Images)
+		if err != nil {
+			return err
+		}
+		oldPaths := old.imagePaths()
+		old.Images = images
+		err = setImageRefs(txn, string(item.KeyCopy(nil)), oldPaths, old.imagePaths())
+		if err != nil {
+			return err
+		}
 		old.UpdateTime = time.Now()
 
 		data, err = json.Marshal(old)
@@ -153,13 +485,137 @@ func (g Goods) UpdateSold(lid, id uint64, inc uint64) error {
 		}
 		return txn.Set(item.KeyCopy(nil), data)
 	})
+	return images, err
 }
 
+// RemoveCategory 分类删除后从商品中移除. 在事务中重新读取每个商品, 与并发修改冲突时整体失败
+func (g Goods) RemoveCategory(lid, cid uint64) error {
+	goods, err := g.GetGoods(lid)
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for _, v := range goods {
+			if !set.From(v.Categories).Has(cid) {
+				continue
+			}
+			item, err := txn.Get([]byte(g.GetKey(lid, v.ID)))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var old Goods
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(data, &old)
+			if err != nil {
+				return err
+			}
+			old.Categories = set.From(old.Categories).Del(cid).ToSlice()
+			old.UpdateTime = now
+
+			data, err = json.Marshal(old)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(item.KeyCopy(nil), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete 只删除图片引用, 图片由 GCImages 回收
 func (g Goods) Delete(lid, id uint64) error {
-	err := Delete(g.GetKey(lid, id))
+	key := g.GetKey(lid, id)
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		var old Goods
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		err = setImageRefs(txn, key, old.imagePaths(), nil)
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
 	if err != nil {
 		return err
 	}
-	DeleteImageByGoodsID(id)
-	return nil
+	unindexGoods(lid, id)
+	return Model[PriceHistory]().DeleteByGoods(lid, id)
+}
+
+// UpdateSort 按 ids 的顺序设置手动排序, 不在 ids 中的商品保持原值
+func (g Goods) UpdateSort(lid uint64, ids []uint64) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for i, id := range ids {
+			item, err := txn.Get([]byte(g.GetKey(lid, id)))
+			if err != nil {
+				return err
+			}
+			var old Goods
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(data, &old)
+			if err != nil {
+				return err
+			}
+			old.Sort = i + 1
+
+			data, err = json.Marshal(old)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(item.KeyCopy(nil), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (g Goods) UpdatePinned(lid, id uint64, pinned bool) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(g.GetKey(lid, id)))
+		if err != nil {
+			return err
+		}
+		var old Goods
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		old.Pinned = pinned
+		old.UpdateTime = time.Now()
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
 }
@@ -1,38 +1,329 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"mall/set"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/sirupsen/logrus"
+	_ "golang.org/x/image/webp"
 )
 
-func GetGoodsAvatarImageKey(id uint64) string {
-	return fmt.Sprintf("img/avatar/goods/%d", id)
+// ImageGCGrace 未被引用的图片保留时间, 给上传后尚未保存商品/留言的请求留出时间
+const ImageGCGrace = 24 * time.Hour
+
+// ImageMeta 图片元数据, 用于 Content-Type 和 ETag
+type ImageMeta struct {
+	Size       int       `json:"size"`
+	Hash       string    `json:"hash"` // sha256
+	Mime       string    `json:"mime"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	UpdateTime time.Time `json:"update_time"`
 }
 
-func SaveImage(key string, data []byte) error {
-	return GetDB().Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), data)
-	})
+func NewImageMeta(data []byte) ImageMeta {
+	sum := sha256.Sum256(data)
+	meta := ImageMeta{
+		Size:       len(data),
+		Hash:       hex.EncodeToString(sum[:]),
+		Mime:       http.DetectContentType(data),
+		UpdateTime: time.Now(),
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		meta.Width = cfg.Width
+		meta.Height = cfg.Height
+	}
+	return meta
 }
 
-func GetImage(key string) ([]byte, error) {
-	var data []byte
-	err := GetDB().View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+func GetImageMetaKey(key string) string {
+	return "imgmeta/" + key
+}
+
+// GetBlobKey 按内容 hash 存储的图片, 前两位分桶以匹配 /img/:target/:type/:id
+func GetBlobKey(hash string) string {
+	if hash == "" {
+		return "img/blob/"
+	}
+	return fmt.Sprintf("img/blob/%s/%s", hash[:2], hash)
+}
+
+// GetImageRefKey 图片被 owner 引用, owner 如 goods/<lid>/<id>
+func GetImageRefKey(hash, owner string) string {
+	if owner == "" {
+		return fmt.Sprintf("imgref/%s/", hash)
+	}
+	return fmt.Sprintf("imgref/%s/%s", hash, owner)
+}
+
+// ImageHashFromPath 从 /img/blob/xx/<hash>?v=thumb 这样的地址取出 hash
+func ImageHashFromPath(path string) (string, bool) {
+	path, _, _ = strings.Cut(path, "?")
+	if !strings.HasPrefix(path, "/"+GetBlobKey("")) {
+		return "", false
+	}
+	hash := path[strings.LastIndex(path, "/")+1:]
+	if len(hash) != sha256.Size*2 {
+		return "", false
+	}
+	return hash, true
+}
+
+func imageHashes(paths []string) *set.Set[string] {
+	hashes := set.New[string](len(paths))
+	for _, p := range paths {
+		if hash, ok := ImageHashFromPath(p); ok {
+			hashes.Add(hash)
+		}
+	}
+	return hashes
+}
+
+// setImageRefs 更新 owner 引用的图片, 在业务数据的同一事务中调用
+func setImageRefs(txn *badger.Txn, owner string, old, new []string) error {
+	oldHashes, newHashes := imageHashes(old), imageHashes(new)
+	for _, hash := range oldHashes.ToSlice() {
+		if newHashes.Has(hash) {
+			continue
+		}
+		err := txn.Delete([]byte(GetImageRefKey(hash, owner)))
 		if err != nil {
 			return err
 		}
-		val, err := item.ValueCopy(nil)
+	}
+	for _, hash := range newHashes.ToSlice() {
+		if oldHashes.Has(hash) {
+			continue
+		}
+		err := txn.Set([]byte(GetImageRefKey(hash, owner)), []byte("1"))
 		if err != nil {
 			return err
 		}
-		data = val
+	}
+	return nil
+}
+
+// saveImage 先写图片再写元数据, 有元数据的图片一定可读
+func saveImage(key string, data []byte) error {
+	err := imageStore.Set(key, data)
+	if err != nil {
+		return err
+	}
+	return Set(GetImageMetaKey(key), NewImageMeta(data))
+}
+
+// blobMu 图片内容不在 badger 事务中, 保存和回收 blob 时互斥, 见 gcBlob
+var blobMu sync.Mutex
+
+// SaveBlob 按内容存储, 相同内容只存一份; 已存在时刷新时间, 避免刚上传就被回收
+func SaveBlob(data []byte) (string, ImageMeta, error) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	meta := NewImageMeta(data)
+	key := GetBlobKey(meta.Hash)
+	var old ImageMeta
+	err := Get(GetImageMetaKey(key), &old)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return key, meta, err
+	}
+	if err != nil {
+		err = imageStore.Set(key, data)
+		if err != nil {
+			return key, meta, err
+		}
+	}
+	return key, meta, Set(GetImageMetaKey(key), meta)
+}
+
+// GetImageVariantKey 图片缩放后的缓存, 放在原图 key 之下便于一起清理
+func GetImageVariantKey(key, variant string) string {
+	return fmt.Sprintf("imgcache/%s/%s", key, variant)
+}
+
+func SaveImageVariant(key, variant string, data []byte) error {
+	return saveImage(GetImageVariantKey(key, variant), data)
+}
+
+func GetImage(key string) ([]byte, error) {
+	return imageStore.Get(key)
+}
+
+// GetImageWithMeta 读取图片和元数据, 旧图片没有元数据时补上
+func GetImageWithMeta(key string) ([]byte, ImageMeta, error) {
+	data, err := GetImage(key)
+	if err != nil {
+		return nil, ImageMeta{}, err
+	}
+	var meta ImageMeta
+	err = Get(GetImageMetaKey(key), &meta)
+	if err == nil {
+		return data, meta, nil
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ImageMeta{}, err
+	}
+	meta = NewImageMeta(data)
+	return data, meta, Set(GetImageMetaKey(key), meta)
+}
+
+func GetImageVariant(key, variant string) ([]byte, ImageMeta, error) {
+	return GetImageWithMeta(GetImageVariantKey(key, variant))
+}
+
+func deleteImageVariants(key string) error {
+	prefix := GetImageVariantKey(key, "")
+	err := imageStore.DeletePrefix(prefix)
+	if err != nil {
 		return err
+	}
+	return DeleteAllWithPrefix(GetImageMetaKey(prefix))
+}
+
+func DeleteImage(key string) error {
+	err := imageStore.Delete(key)
+	if err != nil {
+		return err
+	}
+	err = Delete(GetImageMetaKey(key))
+	if err != nil {
+		return err
+	}
+	return deleteImageVariants(key)
+}
+
+// DeleteImagesWithPrefix 删除前缀下的所有图片及缓存
+func DeleteImagesWithPrefix(prefix string) error {
+	for _, p := range []string{prefix, "imgcache/" + prefix} {
+		err := imageStore.DeletePrefix(p)
+		if err != nil {
+			return err
+		}
+		err = DeleteAllWithPrefix(GetImageMetaKey(p))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasImageRefs 在 txn 中检查图片是否被引用, 回收时与删除在同一事务中
+func hasImageRefs(txn *badger.Txn, hash string) bool {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	prefix := []byte(GetImageRefKey(hash, ""))
+	it.Seek(prefix)
+	return it.ValidForPrefix(prefix)
+}
+
+// IsPrivateImage 图片只被订单附件引用时不能通过公开的 /img 路由访问.
+// 同样的内容也被商品或留言引用时本来就是公开的
+func IsPrivateImage(hash string) (bool, error) {
+	var private bool
+	err := GetDB().View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := GetImageRefKey(hash, "")
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			owner := strings.TrimPrefix(string(it.Item().Key()), prefix)
+			if !strings.HasPrefix(owner, attachmentKeyPrefix) {
+				private = false
+				return nil
+			}
+			private = true
+		}
+		return nil
 	})
-	return data, err
+	return private, err
 }
 
-func DeleteImageByGoodsID(id uint64) error {
-	return Delete(GetGoodsAvatarImageKey(id))
+// GCImages 删除超过 grace 仍未被引用的图片
+func GCImages(grace time.Duration) (int, error) {
+	prefix := GetImageMetaKey(GetBlobKey(""))
+	metas, err := GetAllWithPrefix[ImageMeta](prefix)
+	if err != nil {
+		return 0, err
+	}
+	var deleted []string
+	for key, meta := range metas {
+		if time.Since(meta.UpdateTime) < grace {
+			continue
+		}
+		key = strings.TrimPrefix(key, GetImageMetaKey(""))
+		ok, err := gcBlob(key, meta, grace)
+		if err != nil {
+			return len(deleted), err
+		}
+		if ok {
+			deleted = append(deleted, key)
+		}
+	}
+	if len(deleted) > 0 {
+		logrus.Infof("image gc deleted %d blobs", len(deleted))
+	}
+	return len(deleted), deleteBlobUsage(deleted)
+}
+
+// gcBlob 在事务中重新读取元数据和引用, 期间被重新上传 (刷新了时间) 或被引用时跳过.
+// 先在事务中删除元数据, 再删除图片内容, 持有 blobMu 避免与 SaveBlob 交错
+func gcBlob(key string, old ImageMeta, grace time.Duration) (bool, error) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	var gone bool
+	metaKey := []byte(GetImageMetaKey(key))
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		var meta ImageMeta
+		err = json.Unmarshal(data, &meta)
+		if err != nil {
+			return err
+		}
+		if !meta.UpdateTime.Equal(old.UpdateTime) || time.Since(meta.UpdateTime) < grace {
+			return nil
+		}
+		if hasImageRefs(txn, meta.Hash) {
+			return nil
+		}
+		gone = true
+		return txn.Delete(metaKey)
+	})
+	// 同时有引用写入, 下次再回收
+	if errors.Is(err, badger.ErrConflict) {
+		return false, nil
+	}
+	if err != nil || !gone {
+		return false, err
+	}
+	err = imageStore.Delete(key)
+	if err != nil {
+		return false, err
+	}
+	return true, deleteImageVariants(key)
 }
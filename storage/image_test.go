@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func setTestImageRefs(t *testing.T, owner string, old, new []string) {
+	t.Helper()
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		return setImageRefs(txn, owner, old, new)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCImages(t *testing.T) {
+	initTestDB(t)
+	key, _, err := SaveBlob([]byte("image a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := []string{"/" + key}
+	setTestImageRefs(t, "goods/100/1", nil, path)
+
+	n, err := GCImages(0)
+	if err != nil || n != 0 {
+		t.Fatalf("gc referenced blob = %d, %v", n, err)
+	}
+	setTestImageRefs(t, "goods/100/1", path, nil)
+	n, err = GCImages(0)
+	if err != nil || n != 1 {
+		t.Fatalf("gc unreferenced blob = %d, %v", n, err)
+	}
+	_, err = GetImage(key)
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("get collected blob error = %v", err)
+	}
+
+	// 回收后重新上传, 内容和元数据都要重新写入
+	_, _, err = SaveBlob([]byte("image a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = GetImageWithMeta(key)
+	if err != nil {
+		t.Fatalf("get re-uploaded blob: %v", err)
+	}
+}
+
+func TestIsPrivateImage(t *testing.T) {
+	initTestDB(t)
+	key, meta, err := SaveBlob([]byte("image a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := []string{"/" + key}
+	attachment := OrderAttachment{}.GetKey(100, 1, 2)
+
+	check := func(want bool) {
+		t.Helper()
+		private, err := IsPrivateImage(meta.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if private != want {
+			t.Fatalf("private = %v, want %v", private, want)
+		}
+	}
+	check(false)
+	setTestImageRefs(t, attachment, nil, path)
+	check(true)
+	setTestImageRefs(t, "goods/100/1", nil, path)
+	check(false)
+	setTestImageRefs(t, "goods/100/1", path, nil)
+	check(true)
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ImageStore 图片内容的存储, 元数据、引用和用量仍在 badger 中.
+// 图片不存在时返回 badger.ErrKeyNotFound, 与业务数据保持一致
+type ImageStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, data []byte) error
+	Delete(key string) error
+	DeletePrefix(prefix string) error
+	// Walk 遍历 prefix 下的所有图片 key, 用于迁移
+	Walk(prefix string, f func(key string) error) error
+}
+
+// 图片内容所在的前缀, 原图和缩放缓存
+var imageStorePrefixes = []string{"img/", "imgcache/"}
+
+const (
+	BadgerImageStore = "badger"
+	FSImageStore     = "fs"
+	S3ImageStore     = "s3"
+)
+
+type ImageStoreConfig struct {
+	Store string        `yaml:"store"` // badger, fs, s3, 默认 badger
+	FS    FSStoreConfig `yaml:"fs"`
+	S3    S3StoreConfig `yaml:"s3"`
+}
+
+type FSStoreConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+var imageStore ImageStore = badgerStore{}
+
+// SetImageStore 在 Init 之前调用, Init 中的迁移会用到
+func SetImageStore(store ImageStore) {
+	imageStore = store
+}
+
+func GetImageStore() ImageStore {
+	return imageStore
+}
+
+// NewImageStore 按配置创建图片存储, kind 为空时使用 cfg.Store
+func NewImageStore(cfg ImageStoreConfig, kind string) (ImageStore, error) {
+	if kind == "" {
+		kind = cfg.Store
+	}
+	switch kind {
+	case "", BadgerImageStore:
+		return badgerStore{}, nil
+	case FSImageStore:
+		return NewFSStore(cfg.FS.Dir)
+	case S3ImageStore:
+		return NewS3Store(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown image store:%s", kind)
+}
+
+// MigrateImages 把图片从 from 复制到 to, del 为 true 时复制后删除源图片
+func MigrateImages(from, to ImageStore, del bool) (int, error) {
+	var count int
+	for _, prefix := range imageStorePrefixes {
+		err := from.Walk(prefix, func(key string) error {
+			data, err := from.Get(key)
+			if err != nil {
+				return err
+			}
+			err = to.Set(key, data)
+			if err != nil {
+				return err
+			}
+			count++
+			if del {
+				return from.Delete(key)
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// badgerStore 图片和业务数据放在同一个库中
+type badgerStore struct{}
+
+func (badgerStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := GetDB().View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	return data, err
+}
+
+func (badgerStore) Set(key string, data []byte) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	})
+}
+
+func (badgerStore) Delete(key string) error {
+	return Delete(key)
+}
+
+func (badgerStore) DeletePrefix(prefix string) error {
+	return DeleteAllWithPrefix(prefix)
+}
+
+func (badgerStore) Walk(prefix string, f func(key string) error) error {
+	var keys []string
+	err := GetDB().View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			keys = append(keys, string(it.Item().KeyCopy(nil)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := f(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsStore 图片按 key 存为本地文件
+type fsStore struct {
+	dir string
+}
+
+func NewFSStore(dir string) (ImageStore, error) {
+	if dir == "" {
+		return nil, errors.New("image fs dir is empty")
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &fsStore{dir: dir}, nil
+}
+
+func (s *fsStore) path(key string) (string, error) {
+	for _, v := range strings.Split(key, "/") {
+		if v == ".." {
+			return "", fmt.Errorf("invalid image key:%s", key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *fsStore) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, badger.ErrKeyNotFound
+	}
+	return data, err
+}
+
+// Set 先写临时文件再改名, 避免读到写了一半的图片
+func (s *fsStore) Set(key string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *fsStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsStore) DeletePrefix(prefix string) error {
+	// 前缀以 / 结尾时对应一个目录
+	if strings.HasSuffix(prefix, "/") {
+		p, err := s.path(prefix)
+		if err != nil {
+			return err
+		}
+		return os.RemoveAll(p)
+	}
+	return s.Walk(prefix, s.Delete)
+}
+
+func (s *fsStore) Walk(prefix string, f func(key string) error) error {
+	// 从前缀所在的目录开始遍历
+	root, err := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return err
+	}
+	var keys []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := f(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3StoreConfig 兼容 S3 协议的对象存储, 如 MinIO、OSS、COS
+type S3StoreConfig struct {
+	Endpoint  string `yaml:"endpoint"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	Prefix    string `yaml:"prefix"` // 对象名前缀, 多个环境共用一个 bucket 时使用
+	UseSSL    bool   `yaml:"use_ssl"`
+}
+
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Store 连接对象存储, bucket 不存在时创建
+func NewS3Store(cfg S3StoreConfig) (ImageStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("image s3 endpoint or bucket is empty")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &s3Store{client: client, bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.convertError(err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, s.convertError(err)
+	}
+	return data, nil
+}
+
+func (s *s3Store) Set(key string, data []byte) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.prefix+key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: http.DetectContentType(data),
+	})
+	return err
+}
+
+func (s *s3Store) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) DeletePrefix(prefix string) error {
+	ctx := context.Background()
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true})
+	for e := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if e.Err != nil {
+			return e.Err
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) Walk(prefix string, f func(key string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		err := f(obj.Key[len(s.prefix):])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) convertError(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return badger.ErrKeyNotFound
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// initTestDB 在临时目录中打开数据库, 测试结束时关闭
+func initTestDB(t *testing.T) {
+	t.Helper()
+	err := Init(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Close)
+}
+
+// testImageStore 各存储实现需要满足的读写、遍历和删除行为
+func testImageStore(t *testing.T, store ImageStore) {
+	t.Helper()
+	images := map[string][]byte{
+		"img/blob/aa/aa01": []byte("image a"),
+		"img/blob/ab/ab01": []byte("image b"),
+		"imgcache/thumb/x": []byte("thumb"),
+	}
+	for key, data := range images {
+		err := store.Set(key, data)
+		if err != nil {
+			t.Fatalf("set %s: %v", key, err)
+		}
+	}
+	for key, data := range images {
+		got, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("get %s = %q, want %q", key, got, data)
+		}
+	}
+	// 覆盖写入
+	err := store.Set("img/blob/aa/aa01", []byte("image a2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("img/blob/aa/aa01")
+	if err != nil || string(got) != "image a2" {
+		t.Fatalf("get after overwrite = %q, %v", got, err)
+	}
+	_, err = store.Get("img/blob/zz/none")
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("get missing error = %v, want ErrKeyNotFound", err)
+	}
+
+	var keys []string
+	err = store.Walk("img/blob/a", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "img/blob/aa/aa01" || keys[1] != "img/blob/ab/ab01" {
+		t.Fatalf("walk = %v", keys)
+	}
+
+	err = store.Delete("img/blob/ab/ab01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 删除不存在的图片不报错
+	err = store.Delete("img/blob/ab/ab01")
+	if err != nil {
+		t.Fatalf("delete missing: %v", err)
+	}
+	_, err = store.Get("img/blob/ab/ab01")
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("get deleted error = %v", err)
+	}
+
+	err = store.DeletePrefix("img/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get("img/blob/aa/aa01")
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("get after delete prefix error = %v", err)
+	}
+	got, err = store.Get("imgcache/thumb/x")
+	if err != nil || string(got) != "thumb" {
+		t.Fatalf("delete prefix removed other prefix: %q, %v", got, err)
+	}
+	err = store.DeletePrefix("imgcache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadgerStore(t *testing.T) {
+	initTestDB(t)
+	testImageStore(t, badgerStore{})
+}
+
+func TestFSStore(t *testing.T) {
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImageStore(t, store)
+
+	_, err = store.Get("img/../../etc/passwd")
+	if err == nil {
+		t.Fatal("get with .. should fail")
+	}
+}
+
+// 需要可用的 MinIO, 如:
+//
+//	MINIO_ENDPOINT=127.0.0.1:9000 MINIO_ACCESS_KEY=minioadmin MINIO_SECRET_KEY=minioadmin go test ./storage -run S3
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT not set")
+	}
+	bucket := os.Getenv("MINIO_BUCKET")
+	if bucket == "" {
+		bucket = "mall-test"
+	}
+	store, err := NewS3Store(S3StoreConfig{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("MINIO_ACCESS_KEY"),
+		SecretKey: os.Getenv("MINIO_SECRET_KEY"),
+		Bucket:    bucket,
+		Prefix:    "test/",
+		UseSSL:    os.Getenv("MINIO_USE_SSL") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImageStore(t, store)
+}
+
+func TestMigrateImages(t *testing.T) {
+	initTestDB(t)
+	from := badgerStore{}
+	to, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = from.Set("img/blob/aa/aa01", []byte("image a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = from.Set("imgcache/thumb/x", []byte("thumb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := MigrateImages(from, to, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("migrated %d images, want 2", count)
+	}
+	got, err := to.Get("img/blob/aa/aa01")
+	if err != nil || string(got) != "image a" {
+		t.Fatalf("get migrated = %q, %v", got, err)
+	}
+	_, err = from.Get("img/blob/aa/aa01")
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("source not deleted: %v", err)
+	}
+}
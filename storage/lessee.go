@@ -3,7 +3,8 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
-	"mall/set"
+	"mall/geo"
+	"math"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -17,14 +18,86 @@ const (
 	Enabled  LesseeStatus = "enabled"
 )
 
+type AreaKind string
+
+const (
+	Polygon AreaKind = "polygon"
+	Circle  AreaKind = "circle"
+)
+
+// ServiceArea 服务范围, 多边形或圆心+半径(米)
+type ServiceArea struct {
+	Name    string     `json:"name"`
+	Kind    AreaKind   `json:"kind"`
+	Center  *Location  `json:"center,omitempty"`
+	Radius  float64    `json:"radius,omitempty"`
+	Polygon []Location `json:"polygon,omitempty"`
+}
+
+func (a *ServiceArea) IsValid() (bool, string) {
+	switch a.Kind {
+	case Circle:
+		if a.Center == nil || !a.Center.IsValid() {
+			return false, "圆心坐标错误"
+		}
+		if a.Radius <= 0 {
+			return false, "半径需大于0"
+		}
+	case Polygon:
+		if len(a.Polygon) < 3 {
+			return false, "多边形至少需要3个点"
+		}
+		for i := range a.Polygon {
+			if !a.Polygon[i].IsValid() {
+				return false, "多边形坐标错误"
+			}
+		}
+	default:
+		return false, "服务范围类型错误"
+	}
+	return true, ""
+}
+
+func (a *ServiceArea) points() []geo.Point {
+	var ps = make([]geo.Point, 0, len(a.Polygon))
+	for _, v := range a.Polygon {
+		ps = append(ps, v.Point())
+	}
+	return ps
+}
+
+func (a *ServiceArea) Contains(loc Location) bool {
+	switch a.Kind {
+	case Circle:
+		return a.Center != nil && geo.Distance(a.Center.Point(), loc.Point()) <= a.Radius
+	case Polygon:
+		return geo.InPolygon(loc.Point(), a.points())
+	}
+	return false
+}
+
+// Distance 到服务范围中心的距离(米)
+func (a *ServiceArea) Distance(loc Location) float64 {
+	switch a.Kind {
+	case Circle:
+		if a.Center != nil {
+			return geo.Distance(a.Center.Point(), loc.Point())
+		}
+	case Polygon:
+		return geo.Distance(geo.Centroid(a.points()), loc.Point())
+	}
+	return math.MaxFloat64
+}
+
 type Lessee struct {
-	ID         uint64       `json:"id"`
-	Admins     []uint64     `json:"admins"`
-	Techs      []uint64     `json:"techs"`
-	Name       string       `json:"name"`
-	Status     LesseeStatus `json:"enable"`
-	CreateTime time.Time    `json:"create_time"`
-	UpdateTime time.Time    `json:"update_time"`
+	ID               uint64        `json:"id"`
+	Name             string        `json:"name"`
+	Status           LesseeStatus  `json:"enable"`
+	RequireDonePhoto bool          `json:"require_done_photo"` // 订单完成前至少需要上传一张照片
+	Areas            []ServiceArea `json:"areas"`              // 为空表示不限制服务范围
+	ImageQuota       int64         `json:"image_quota"`        // 图片存储配额(字节), 0 为默认配额
+	CreateTime       time.Time     `json:"create_time"`
+	UpdateTime       time.Time     `json:"update_time"`
 }
 
 func (l *Lessee) IsValid() (bool, string) {
@@ -41,6 +114,31 @@ func (l *Lessee) IsValid() (bool, string) {
 	return true, ""
 }
 
+// Serves 未设置服务范围时不做限制
+func (l *Lessee) Serves(loc *Location) bool {
+	if len(l.Areas) == 0 {
+		return true
+	}
+	if loc == nil {
+		return false
+	}
+	for i := range l.Areas {
+		if l.Areas[i].Contains(*loc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Distance 到最近服务范围中心的距离(米)
+func (l *Lessee) Distance(loc Location) float64 {
+	var d = math.MaxFloat64
+	for i := range l.Areas {
+		d = math.Min(d, l.Areas[i].Distance(loc))
+	}
+	return d
+}
+
 func (Lessee) GetKey(id uint64) string {
 	if id == 0 {
 		return "lessee/"
@@ -57,7 +155,7 @@ func (l Lessee) GetByID(id uint64) (Lessee, error) {
 	return lessee, err
 }
 
-func (l Lessee) Update(id uint64, name string, status LesseeStatus) error {
+func (l Lessee) Update(id uint64, name string, status LesseeStatus, requireDonePhoto *bool, imageQuota *int64) error {
 	return GetDB().Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(l.GetKey(id)))
 		if err != nil {
@@ -80,34 +178,12 @@ func (l Lessee) Update(id uint64, name string, status LesseeStatus) error {
 		if name != "" {
 			old.Name = name
 		}
-		old.UpdateTime = time.Now()
-
-		data, err = json.Marshal(old)
-		if err != nil {
-			return err
+		if requireDonePhoto != nil {
+			old.RequireDonePhoto = *requireDonePhoto
 		}
-		return txn.Set(item.KeyCopy(nil), data)
-	})
-}
-
-func (l Lessee) UpdateManger(id uint64, add, del []uint64) error {
-	return GetDB().Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(l.GetKey(id)))
-		if err != nil {
-			return err
+		if imageQuota != nil {
+			old.ImageQuota = *imageQuota
 		}
-		var old Lessee
-		data, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		err = json.Unmarshal(data, &old)
-		if err != nil {
-			return err
-		}
-
-		old.Admins = set.From(old.Admins).Add(add...).Del(del...).ToSlice()
-
 		old.UpdateTime = time.Now()
 
 		data, err = json.Marshal(old)
@@ -118,7 +194,7 @@ func (l Lessee) UpdateManger(id uint64, add, del []uint64) error {
 	})
 }
 
-func (l Lessee) UpdateTech(id uint64, add, del []uint64) error {
+func (l Lessee) UpdateAreas(id uint64, areas []ServiceArea) error {
 	return GetDB().Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(l.GetKey(id)))
 		if err != nil {
@@ -134,8 +210,7 @@ func (l Lessee) UpdateTech(id uint64, add, del []uint64) error {
 			return err
 		}
 
-		old.Techs = set.From(old.Techs).Add(add...).Del(del...).ToSlice()
-
+		old.Areas = areas
 		old.UpdateTime = time.Now()
 
 		data, err = json.Marshal(old)
@@ -160,5 +235,21 @@ func (l Lessee) GetLessees() ([]Lessee, error) {
 }
 
 func (l Lessee) Delete(id uint64) error {
-	return Delete(l.GetKey(id))
+	err := Delete(l.GetKey(id))
+	if err != nil {
+		return err
+	}
+	err = Model[Member]().DeleteByLessee(id)
+	if err != nil {
+		return err
+	}
+	err = Model[Role]().DeleteByLessee(id)
+	if err != nil {
+		return err
+	}
+	err = Model[APIKey]().DeleteByLessee(id)
+	if err != nil {
+		return err
+	}
+	return Model[Block]().DeleteByLessee(id)
 }
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	// 商品详情由租户填写, 渲染后再过滤一次, 只保留常规排版标签
+	htmlPolicy = bluemonday.UGCPolicy()
+)
+
+func renderMarkdown(src string) string {
+	if src == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(src), &buf)
+	if err != nil {
+		return ""
+	}
+	return htmlPolicy.Sanitize(buf.String())
+}
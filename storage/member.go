@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Member 用户在租户中的角色, 一个用户在每个租户中只有一个角色, 可以是内置角色或租户自定义角色.
+// 按租户和按用户各存一份, 不在租户中的用户视为客户
+type Member struct {
+	UserID     uint64    `json:"user_id"`
+	LesseeID   uint64    `json:"lessee_id"`
+	Role       UserKind  `json:"role"`
+	CreateTime time.Time `json:"create_time"`
+}
+
+func (m *Member) IsValid() (bool, string) {
+	if m.UserID == 0 || m.LesseeID == 0 {
+		return false, "成员错误"
+	}
+	// 客户不需要保存, 平台管理员不属于租户
+	if m.Role == "" || m.Role == Customer || m.Role == Admin {
+		return false, "角色错误"
+	}
+	return true, ""
+}
+
+func (Member) GetKey(lid, uid uint64) string {
+	if uid == 0 {
+		return fmt.Sprintf("member/lessee/%d/", lid)
+	}
+	return fmt.Sprintf("member/lessee/%d/%d", lid, uid)
+}
+
+func (Member) GetUserKey(uid, lid uint64) string {
+	if lid == 0 {
+		return fmt.Sprintf("member/user/%d/", uid)
+	}
+	return fmt.Sprintf("member/user/%d/%d", uid, lid)
+}
+
+func setMember(txn *badger.Txn, m Member) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = txn.Set([]byte(m.GetKey(m.LesseeID, m.UserID)), data)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(m.GetUserKey(m.UserID, m.LesseeID)), data)
+}
+
+func deleteMember(txn *badger.Txn, lid, uid uint64) error {
+	var m Member
+	err := txn.Delete([]byte(m.GetKey(lid, uid)))
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(m.GetUserKey(uid, lid)))
+}
+
+func (m *Member) Save() error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return setMember(txn, *m)
+	})
+}
+
+func (m Member) Get(lid, uid uint64) (Member, error) {
+	var member Member
+	err := Get(m.GetKey(lid, uid), &member)
+	return member, err
+}
+
+// GetRole 用户在租户中的角色, 不是成员时为客户
+func (m Member) GetRole(lid, uid uint64) (UserKind, error) {
+	if lid == 0 || uid == 0 {
+		return Customer, nil
+	}
+	member, err := m.Get(lid, uid)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return Customer, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// GetMembers 租户中指定角色的成员, role 为空时返回全部
+func (m Member) GetMembers(lid uint64, role UserKind) ([]Member, error) {
+	mm, err := GetAllWithPrefix[Member](m.GetKey(lid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var members = make([]Member, 0, len(mm))
+	for _, v := range mm {
+		if role == "" || v.Role == role {
+			members = append(members, v)
+		}
+	}
+	return members, nil
+}
+
+func (m Member) GetMemberIDs(lid uint64, role UserKind) ([]uint64, error) {
+	members, err := m.GetMembers(lid, role)
+	if err != nil {
+		return nil, err
+	}
+	var ids = make([]uint64, 0, len(members))
+	for _, v := range members {
+		ids = append(ids, v.UserID)
+	}
+	return ids, nil
+}
+
+// GetByUser 用户加入的所有租户
+func (m Member) GetByUser(uid uint64) ([]Member, error) {
+	mm, err := GetAllWithPrefix[Member](m.GetUserKey(uid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var members = make([]Member, 0, len(mm))
+	for _, v := range mm {
+		members = append(members, v)
+	}
+	return members, nil
+}
+
+// UpdateRole 把 add 中的用户设为 role, 移除 del 中角色为 role 的用户
+func (m Member) UpdateRole(lid uint64, role UserKind, add, del []uint64) error {
+	var now = time.Now()
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for _, uid := range add {
+			err := setMember(txn, Member{UserID: uid, LesseeID: lid, Role: role, CreateTime: now})
+			if err != nil {
+				return err
+			}
+		}
+		for _, uid := range del {
+			item, err := txn.Get([]byte(m.GetKey(lid, uid)))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var old Member
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &old)
+			})
+			if err != nil {
+				return err
+			}
+			if old.Role != role {
+				continue
+			}
+			err = deleteMember(txn, lid, uid)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m Member) DeleteByLessee(lid uint64) error {
+	members, err := m.GetMembers(lid, "")
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for _, v := range members {
+			if err := deleteMember(txn, v.LesseeID, v.UserID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m Member) DeleteByUser(uid uint64) error {
+	members, err := m.GetByUser(uid)
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for _, v := range members {
+			if err := deleteMember(txn, v.LesseeID, v.UserID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const imageBlobMigrateKey = "migrate/image-blob"
+
+// 按商品 id 存储的旧图片前缀
+var legacyImagePrefixes = []string{"img/avatar/goods/", "img/goods/"}
+
+// migrateImageBlobs 把旧的按商品 id 存储的图片转为按内容存储, 只执行一次
+func migrateImageBlobs() error {
+	var done bool
+	err := Get(imageBlobMigrateKey, &done)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	var failed, n int
+	n, err = migrateImagePaths("goods/", func(g *Goods) []*string {
+		paths := []*string{&g.Avatar}
+		for i := range g.Images {
+			paths = append(paths, &g.Images[i])
+		}
+		return paths
+	})
+	if err != nil {
+		return err
+	}
+	failed += n
+	n, err = migrateImagePaths("category/", func(c *Category) []*string {
+		return []*string{&c.Icon}
+	})
+	if err != nil {
+		return err
+	}
+	failed += n
+	n, err = migrateImagePaths("order/comment/", func(c *OrderComment) []*string {
+		paths := make([]*string, 0, len(c.Images))
+		for i := range c.Images {
+			paths = append(paths, &c.Images[i])
+		}
+		return paths
+	})
+	if err != nil {
+		return err
+	}
+	failed += n
+	// 有图片复制失败时保留旧图片, 下次启动重试
+	if failed > 0 {
+		logrus.Errorf("migrate images to blob store: %d images failed, keep legacy images and retry on next start", failed)
+		return nil
+	}
+
+	// 旧图片都在 badger 中, 与当前使用的图片存储无关
+	for _, prefix := range legacyImagePrefixes {
+		for _, p := range []string{prefix, "imgcache/" + prefix} {
+			err = DeleteAllWithPrefix(p)
+			if err != nil {
+				return err
+			}
+			err = DeleteAllWithPrefix(GetImageMetaKey(p))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	logrus.Infoln("migrate images to blob store done")
+	return Set(imageBlobMigrateKey, true)
+}
+
+// migrateImagePaths 替换 prefix 下每条数据中的旧图片地址, 并记录引用, 返回复制失败的图片数.
+// 旧图片已经不存在的不算失败
+func migrateImagePaths[T any](prefix string, paths func(*T) []*string) (int, error) {
+	m, err := GetAllWithPrefix[T](prefix)
+	if err != nil {
+		return 0, err
+	}
+	var failed int
+	for key, v := range m {
+		var changed bool
+		var refs []string
+		for _, p := range paths(&v) {
+			path, ok, err := migrateImagePath(*p)
+			if err != nil {
+				logrus.Errorf("migrate image %s of %s error:%v", *p, key, err)
+				if !errors.Is(err, badger.ErrKeyNotFound) {
+					failed++
+				}
+				refs = append(refs, *p)
+				continue
+			}
+			if ok {
+				*p = path
+				changed = true
+			}
+			refs = append(refs, *p)
+		}
+		if !changed {
+			continue
+		}
+		err = GetDB().Update(func(txn *badger.Txn) error {
+			err := setImageRefs(txn, key, nil, refs)
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return txn.Set([]byte(key), data)
+		})
+		if err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// migrateImagePath 旧地址如 /img/goods/1/2?v=thumb&h=xx 转为 /img/blob/ab/<hash>?v=thumb
+func migrateImagePath(path string) (string, bool, error) {
+	p, query, _ := strings.Cut(path, "?")
+	key := strings.TrimPrefix(p, "/")
+	var legacy bool
+	for _, prefix := range legacyImagePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			legacy = true
+		}
+	}
+	if !legacy {
+		return path, false, nil
+	}
+	data, err := badgerStore{}.Get(key)
+	if err != nil {
+		return path, false, err
+	}
+	blob, _, err := SaveBlob(data)
+	if err != nil {
+		return path, false, err
+	}
+	path = "/" + blob
+	for _, kv := range strings.Split(query, "&") {
+		if strings.HasPrefix(kv, "v=") {
+			path += "?" + kv
+		}
+	}
+	return path, true, nil
+}
+
+const attachmentBlobMigrateKey = "migrate/attachment-blob"
+
+// migrateAttachmentBlobs 把按订单存储的附件图片转为按内容存储, 只执行一次
+func migrateAttachmentBlobs() error {
+	var done bool
+	err := Get(attachmentBlobMigrateKey, &done)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if done {
+		return nil
+	}
+	attachments, err := GetAllWithPrefix[OrderAttachment]("order/attachment/")
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, a := range attachments {
+		if a.Image != "" {
+			continue
+		}
+		old := getLegacyAttachmentImageKey(a.LesseeID, a.OrderID, a.ID)
+		data, err := imageStore.Get(old)
+		if err != nil {
+			logrus.Errorf("migrate attachment image %s error:%v", old, err)
+			if !errors.Is(err, badger.ErrKeyNotFound) {
+				failed++
+			}
+			continue
+		}
+		key, _, err := SaveBlob(data)
+		if err != nil {
+			return err
+		}
+		a.Image = key
+		err = GetDB().Update(func(txn *badger.Txn) error {
+			// 用量从旧 key 转到 blob, 与上传时的记法一致
+			usage := []byte(GetImageUsageKey(a.LesseeID, old))
+			item, err := txn.Get(usage)
+			if err == nil {
+				size, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				err = txn.Set([]byte(GetImageUsageKey(a.LesseeID, key)), size)
+				if err != nil {
+					return err
+				}
+				err = txn.Delete(usage)
+				if err != nil {
+					return err
+				}
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			return setAttachment(txn, &a)
+		})
+		if err != nil {
+			return err
+		}
+		err = DeleteImage(old)
+		if err != nil {
+			return err
+		}
+	}
+	// 已迁移的附件有 Image, 重试时跳过
+	if failed > 0 {
+		logrus.Errorf("migrate order attachments to blob store: %d images failed, retry on next start", failed)
+		return nil
+	}
+	logrus.Infoln("migrate order attachments to blob store done")
+	return Set(attachmentBlobMigrateKey, true)
+}
+
+const memberMigrateKey = "migrate/member"
+
+// migrateMembers 把租户中的 admins/techs 和用户的全局角色转为租户成员, 只执行一次
+func migrateMembers() error {
+	var done bool
+	err := Get(memberMigrateKey, &done)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if done {
+		return nil
+	}
+
+	type legacyLessee struct {
+		Lessee
+		Admins []uint64 `json:"admins"`
+		Techs  []uint64 `json:"techs"`
+	}
+	lessees, err := GetAllWithPrefix[legacyLessee](Model[Lessee]().GetKey(0))
+	if err != nil {
+		return err
+	}
+	for key, l := range lessees {
+		err = GetDB().Update(func(txn *badger.Txn) error {
+			// 同时是管理员和师傅的按管理员处理
+			var roles = make(map[uint64]UserKind)
+			for _, uid := range l.Techs {
+				roles[uid] = Technician
+			}
+			for _, uid := range l.Admins {
+				roles[uid] = Manger
+			}
+			for uid, role := range roles {
+				err := setMember(txn, Member{UserID: uid, LesseeID: l.ID, Role: role, CreateTime: l.UpdateTime})
+				if err != nil {
+					return err
+				}
+			}
+			data, err := json.Marshal(l.Lessee)
+			if err != nil {
+				return err
+			}
+			return txn.Set([]byte(key), data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// 全局角色只保留平台管理员
+	users, err := GetAllWithPrefix[User](new(User).GetKey(0))
+	if err != nil {
+		return err
+	}
+	for key, u := range users {
+		if u.Kind == Admin || u.Kind == Customer {
+			continue
+		}
+		u.Kind = Customer
+		err = Set(key, u)
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infoln("migrate lessee members done")
+	return Set(memberMigrateKey, true)
+}
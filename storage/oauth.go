@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// OAuthStateTTL 扫码登录的二维码有效期
+const OAuthStateTTL = 10 * time.Minute
+
+func getOAuthStateKey(state string) string {
+	return fmt.Sprintf("oauth/state/%s", state)
+}
+
+// NewOAuthState 生成一次性的 state, 防止回调被伪造
+func NewOAuthState() (string, error) {
+	state, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	return state, Set(getOAuthStateKey(state), true, OAuthStateTTL)
+}
+
+// TakeOAuthState 校验并删除 state, 每个 state 只能用一次
+func TakeOAuthState(state string) (bool, error) {
+	if state == "" {
+		return false, nil
+	}
+	var ok bool
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		key := []byte(getOAuthStateKey(state))
+		_, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ok = true
+		return txn.Delete(key)
+	})
+	return ok, err
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mall/set"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -52,11 +53,41 @@ func (s OrderStatus) IsValid() bool {
 	return true
 }
 
+// ErrOrderStatus 不允许的状态变化, 或修改已结束的订单
+var ErrOrderStatus = errors.New("order status transition not allowed")
+
+// orderTransitions 允许的状态变化. 完成和取消是终态, 取消的订单不能重新打开,
+// 库存和限量只在取消时回退一次
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	Watting: {Comfirm, Done, Canceled},
+	Comfirm: {Watting, Done, Canceled},
+}
+
+// CanTransit 状态 s 能否变为 to
+func (s OrderStatus) CanTransit(to OrderStatus) bool {
+	for _, v := range orderTransitions[s] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsClosed 完成或取消的订单不能再修改
+func (s OrderStatus) IsClosed() bool {
+	return len(orderTransitions[s]) == 0
+}
+
 type OrderGoods struct {
-	ID    uint64  `json:"id"`
-	Price float64 `json:"price"`
-	Name  string  `json:"name"`
-	Count int     `json:"count"`
+	ID      uint64  `json:"id"`
+	SkuID   uint64  `json:"sku_id,omitempty"`
+	SkuName string  `json:"sku_name,omitempty"`
+	Price   float64 `json:"price"`
+	Name    string  `json:"name"`
+	Count   int     `json:"count"`
+	// 下单时使用的活动价, 取消订单时回退活动限量
+	RuleID   uint64 `json:"rule_id,omitempty"`
+	RuleName string `json:"rule_name,omitempty"`
 }
 
 type SimpleUser struct {
@@ -64,11 +95,15 @@ type SimpleUser struct {
 	Nickname string `json:"nickname"`
 }
 
+// OrderReverse 预约信息, 选择地址簿时为下单时的快照, 之后修改地址簿不影响订单
 type OrderReverse struct {
-	Time    string `json:"time"`
-	Address string `json:"address"`
-	Phone   string `json:"phone"`
-	Remark  string `json:"remark"`
+	Time      string    `json:"time"`
+	AddressID uint64    `json:"address_id,omitempty"`
+	Contact   string    `json:"contact,omitempty"`
+	Address   string    `json:"address"`
+	Location  *Location `json:"location,omitempty"`
+	Phone     string    `json:"phone"`
+	Remark    string    `json:"remark"`
 }
 
 type Order struct {
@@ -172,7 +207,7 @@ func (o *Order) Save() error {
 
 		var g Goods
 		for _, goods := range o.Goods {
-			err := g.UpdateSold(o.LesseeID, goods.ID, uint64(goods.Count))
+			err := g.updateSold(txn, o.LesseeID, goods.ID, goods.SkuID, goods.RuleID, goods.Count)
 			if err != nil {
 				return err
 			}
@@ -201,6 +236,12 @@ func (o Order) Update(lid, id uint64, address string, reverseTime string, phone
 		if err != nil {
 			return err
 		}
+		if old.Status.IsClosed() {
+			return ErrOrderStatus
+		}
+		if status != "" && status != old.Status && !old.Status.CanTransit(status) {
+			return ErrOrderStatus
+		}
 
 		if address != "" {
 			old.Reverse.Address = address
@@ -213,6 +254,17 @@ func (o Order) Update(lid, id uint64, address string, reverseTime string, phone
 		}
 
 		if status != "" && status != old.Status {
+			// 取消订单时回退销量, 规格库存和活动限量
+			if status == Canceled {
+				var g Goods
+				for _, goods := range old.Goods {
+					// 商品已删除时无需回退
+					err := g.updateSold(txn, old.LesseeID, goods.ID, goods.SkuID, goods.RuleID, -goods.Count)
+					if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+						return err
+					}
+				}
+			}
 			old.Status = status
 		}
 
@@ -227,8 +279,65 @@ func (o Order) Update(lid, id uint64, address string, reverseTime string, phone
 	return &old, err
 }
 
+// Touch 仅刷新更新时间, 让客户端的 pre/HEAD 轮询感知到变化
+func (o Order) Touch(lid, id uint64) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(o.GetKey(lid, id)))
+		if err != nil {
+			return err
+		}
+		var old Order
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		old.UpdateTime = time.Now()
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+}
+
+// Readers 订单参与人: 下单客户, 指派师傅, 可以查看所有订单的成员
+func (o Order) Readers() ([]uint64, error) {
+	managers, err := Model[Member]().GetMembersWith(o.LesseeID, PermOrderRead)
+	if err != nil {
+		return nil, err
+	}
+	readers := set.From(managers).Add(o.User.ID)
+	if o.Tech.ID != 0 {
+		readers.Add(o.Tech.ID)
+	}
+	return readers.ToSlice(), nil
+}
+
 func (o Order) Delete(lid, id uint64) error {
-	return Delete(o.GetKey(lid, id))
+	order, err := o.GetByID(lid, id)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	var readers []uint64
+	if err == nil {
+		readers, err = order.Readers()
+		if err != nil {
+			return err
+		}
+	}
+	err = Delete(o.GetKey(lid, id))
+	if err != nil {
+		return err
+	}
+	err = Model[OrderComment]().DeleteByOrder(lid, id, readers)
+	if err != nil {
+		return err
+	}
+	return Model[OrderAttachment]().DeleteByOrder(lid, id)
 }
 
 func (o Order) GetByUid(lid, uid uint64, status OrderStatus) ([]Order, error) {
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"mall/set"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type Permission string
+
+const (
+	PermPlatform      Permission = "platform.manage"       // 平台管理: 租户的创建修改删除, 存储配额, 删除订单和用户
+	PermGoodsWrite    Permission = "goods.write"           // 商品和分类的增删改, 查看下架商品
+	PermOrderRead     Permission = "order.read"            // 查看租户的所有订单
+	PermOrderAssign   Permission = "order.assign"          // 接单, 确认和完成订单
+	PermOrderCancel   Permission = "order.cancel"          // 取消他人的订单
+	PermOrderService  Permission = "order.service"         // 上传服务照片, 删除他人的附件
+	PermCommentDelete Permission = "order.comment.delete"  // 删除他人的留言
+	PermJoinDecide    Permission = "join.decide"           // 处理加入申请
+	PermMembersManage Permission = "lessee.members.manage" // 成员和自定义角色
+	PermLesseeUpdate  Permission = "lessee.update"         // 服务范围和存储用量
+	PermUserRead      Permission = "user.read"             // 查看用户列表
+	PermAPIKeyManage  Permission = "lessee.apikey.manage"  // 创建和撤销系统集成密钥
+	PermBlockManage   Permission = "lessee.block.manage"   // 黑名单
+)
+
+// LesseePermissions 可以分配给租户角色的权限, 平台权限只属于平台管理员
+var LesseePermissions = []Permission{
+	PermGoodsWrite,
+	PermOrderRead,
+	PermOrderAssign,
+	PermOrderCancel,
+	PermOrderService,
+	PermCommentDelete,
+	PermJoinDecide,
+	PermMembersManage,
+	PermLesseeUpdate,
+	PermUserRead,
+	PermAPIKeyManage,
+	PermBlockManage,
+}
+
+// 内置角色, 所有租户通用
+var builtinRoles = map[UserKind][]Permission{
+	Manger:     LesseePermissions,
+	Technician: {PermOrderAssign, PermOrderCancel},
+	Customer:   nil,
+}
+
+func IsBuiltinRole(name UserKind) bool {
+	_, ok := builtinRoles[name]
+	return ok || name == Admin
+}
+
+// Role 租户自定义的角色, 由一组权限组成
+type Role struct {
+	LesseeID    uint64       `json:"lessee_id"`
+	Name        UserKind     `json:"name"`
+	Builtin     bool         `json:"builtin"` // 只用于展示, 不保存
+	Permissions []Permission `json:"permissions"`
+	CreateTime  time.Time    `json:"create_time"`
+	UpdateTime  time.Time    `json:"update_time"`
+}
+
+func (r *Role) IsValid() (bool, string) {
+	if r.LesseeID == 0 {
+		return false, "非法租户"
+	}
+	if r.Name == "" {
+		return false, "角色名为空"
+	}
+	if IsBuiltinRole(r.Name) {
+		return false, "不能修改内置角色"
+	}
+	allowed := set.From(LesseePermissions)
+	for _, p := range r.Permissions {
+		if !allowed.Has(p) {
+			return false, fmt.Sprintf("权限错误:%s", p)
+		}
+	}
+	return true, ""
+}
+
+func (Role) GetKey(lid uint64, name UserKind) string {
+	if name == "" {
+		return fmt.Sprintf("role/%d/", lid)
+	}
+	return fmt.Sprintf("role/%d/%s", lid, name)
+}
+
+func (r *Role) Save() error {
+	r.Builtin = false
+	return Set(r.GetKey(r.LesseeID, r.Name), r)
+}
+
+func (r Role) Get(lid uint64, name UserKind) (Role, error) {
+	if perms, ok := builtinRoles[name]; ok {
+		return Role{LesseeID: lid, Name: name, Builtin: true, Permissions: perms}, nil
+	}
+	var role Role
+	err := Get(r.GetKey(lid, name), &role)
+	return role, err
+}
+
+// GetRoles 内置角色和租户的自定义角色
+func (r Role) GetRoles(lid uint64) ([]Role, error) {
+	m, err := GetAllWithPrefix[Role](r.GetKey(lid, ""))
+	if err != nil {
+		return nil, err
+	}
+	var roles = make([]Role, 0, len(builtinRoles)+len(m))
+	for _, name := range []UserKind{Manger, Technician, Customer} {
+		role, _ := r.Get(lid, name)
+		roles = append(roles, role)
+	}
+	for _, v := range m {
+		roles = append(roles, v)
+	}
+	return roles, nil
+}
+
+func (r Role) Delete(lid uint64, name UserKind) error {
+	return Delete(r.GetKey(lid, name))
+}
+
+func (r Role) DeleteByLessee(lid uint64) error {
+	return DeleteAllWithPrefix(r.GetKey(lid, ""))
+}
+
+// HasPermission 平台管理员拥有所有权限; 角色不存在时没有任何权限
+func (r Role) HasPermission(lid uint64, name UserKind, perm Permission) (bool, error) {
+	if name == Admin {
+		return true, nil
+	}
+	if name == "" || lid == 0 {
+		return false, nil
+	}
+	role, err := r.Get(lid, name)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return set.From(role.Permissions).Has(perm), nil
+}
+
+// GetMembersWith 租户中拥有权限 perm 的成员
+func (m Member) GetMembersWith(lid uint64, perm Permission) ([]uint64, error) {
+	members, err := m.GetMembers(lid, "")
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, v := range members {
+		ok, err := Model[Role]().HasPermission(lid, v.Role, perm)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ids = append(ids, v.UserID)
+		}
+	}
+	return ids, nil
+}
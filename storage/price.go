@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ErrPriceChanged 下单时活动已结束或限量已售完
+var ErrPriceChanged = errors.New("price changed")
+
+// PriceRule 限时价格, 在 StartTime 到 EndTime 之间按 SalePrice 售卖
+type PriceRule struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	SkuID     uint64    `json:"sku_id,omitempty"` // 0 对所有规格生效
+	SalePrice float64   `json:"sale_price"`
+	Limit     int       `json:"limit"` // 活动限量, 0 不限
+	Sold      int       `json:"sold"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+func (r *PriceRule) IsValid() (bool, string) {
+	if r.ID == 0 {
+		return false, ""
+	}
+	if r.SalePrice <= 0 {
+		return false, "活动价格错误"
+	}
+	if r.Limit < 0 {
+		return false, "活动限量错误"
+	}
+	if !r.EndTime.After(r.StartTime) {
+		return false, "活动结束时间需晚于开始时间"
+	}
+	return true, ""
+}
+
+// Remain 活动剩余数量, 不限量时返回 -1
+func (r *PriceRule) Remain() int {
+	if r.Limit == 0 {
+		return -1
+	}
+	return max(r.Limit-r.Sold, 0)
+}
+
+func (r *PriceRule) ActiveAt(now time.Time) bool {
+	return !now.Before(r.StartTime) && now.Before(r.EndTime) && r.Remain() != 0
+}
+
+// ActiveRule 对规格生效的活动中价格最低的一个
+func (g *Goods) ActiveRule(skuID uint64, now time.Time) *PriceRule {
+	var rule *PriceRule
+	for i := range g.PriceRules {
+		r := &g.PriceRules[i]
+		if r.SkuID != 0 && r.SkuID != skuID {
+			continue
+		}
+		if !r.ActiveAt(now) {
+			continue
+		}
+		if rule == nil || r.SalePrice < rule.SalePrice {
+			rule = r
+		}
+	}
+	return rule
+}
+
+func (g *Goods) getPriceRule(id uint64) (*PriceRule, bool) {
+	for i := range g.PriceRules {
+		if g.PriceRules[i].ID == id {
+			return &g.PriceRules[i], true
+		}
+	}
+	return nil, false
+}
+
+// ApplyPriceRules 用生效中的活动价格替换 FinalPrice, 只用于展示, 不保存.
+// 活动开始或结束也算作更新, 使 pre 接口的缓存失效
+func (g *Goods) ApplyPriceRules(now time.Time) {
+	if len(g.PriceRules) == 0 {
+		return
+	}
+	if len(g.Skus) == 0 {
+		if rule := g.ActiveRule(0, now); rule != nil && rule.SalePrice < g.FinalPrice {
+			g.FinalPrice = rule.SalePrice
+			g.Sale = rule
+		}
+	} else {
+		for i := range g.Skus {
+			if rule := g.ActiveRule(g.Skus[i].ID, now); rule != nil && rule.SalePrice < g.Skus[i].FinalPrice {
+				g.Skus[i].FinalPrice = rule.SalePrice
+				g.Sale = rule
+			}
+		}
+		g.SyncSkuPrice()
+	}
+	for _, r := range g.PriceRules {
+		for _, t := range []time.Time{r.StartTime, r.EndTime} {
+			if t.After(g.UpdateTime) && !t.After(now) {
+				g.UpdateTime = t
+			}
+		}
+	}
+}
+
+// PriceHistory 商品价格变动记录
+type PriceHistory struct {
+	ID         uint64     `json:"id"`
+	GoodsID    uint64     `json:"goods_id"`
+	SkuID      uint64     `json:"sku_id,omitempty"`
+	Price      float64    `json:"price"`
+	FinalPrice float64    `json:"final_price"`
+	Rule       *PriceRule `json:"rule,omitempty"`
+	Note       string     `json:"note"`
+	CreateTime time.Time  `json:"create_time"`
+}
+
+type PriceHistorySlice []PriceHistory
+
+func (a PriceHistorySlice) Len() int           { return len(a) }
+func (a PriceHistorySlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a PriceHistorySlice) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+func (PriceHistory) GetKey(lid, gid, id uint64) string {
+	if id == 0 {
+		return fmt.Sprintf("price/history/%d/%d/", lid, gid)
+	}
+	return fmt.Sprintf("price/history/%d/%d/%d", lid, gid, id)
+}
+
+func (h PriceHistory) GetHistory(lid, gid uint64) (PriceHistorySlice, error) {
+	m, err := GetAllWithPrefix[PriceHistory](h.GetKey(lid, gid, 0))
+	if err != nil {
+		return nil, err
+	}
+	var history = make(PriceHistorySlice, 0, len(m))
+	for _, v := range m {
+		history = append(history, v)
+	}
+	return history, nil
+}
+
+func (h PriceHistory) DeleteByGoods(lid, gid uint64) error {
+	return DeleteAllWithPrefix(h.GetKey(lid, gid, 0))
+}
+
+func addPriceHistory(txn *badger.Txn, lid uint64, h PriceHistory) error {
+	id, err := GenID()
+	if err != nil {
+		return err
+	}
+	h.ID = id
+	h.CreateTime = time.Now()
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(h.GetKey(lid, h.GoodsID, id)), data)
+}
+
+// addPriceChanges 记录手动修改的价格, old 为 nil 时为新建商品
+func addPriceChanges(txn *badger.Txn, old, g *Goods) error {
+	note := "修改价格"
+	if old == nil {
+		old = &Goods{}
+		note = "新建商品"
+	}
+	if len(g.Skus) == 0 {
+		if g.Price == old.Price && g.FinalPrice == old.FinalPrice {
+			return nil
+		}
+		return addPriceHistory(txn, g.LesseeID, PriceHistory{
+			GoodsID:    g.ID,
+			Price:      g.Price,
+			FinalPrice: g.FinalPrice,
+			Note:       note,
+		})
+	}
+	for _, sku := range g.Skus {
+		if s, ok := old.GetSku(sku.ID); ok && s.Price == sku.Price && s.FinalPrice == sku.FinalPrice {
+			continue
+		}
+		err := addPriceHistory(txn, g.LesseeID, PriceHistory{
+			GoodsID:    g.ID,
+			SkuID:      sku.ID,
+			Price:      sku.Price,
+			FinalPrice: sku.FinalPrice,
+			Note:       note,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updatePriceRules 修改商品的活动, f 返回修改后的活动和变动说明
+func (g Goods) updatePriceRules(lid, id uint64, f func(old *Goods) (*PriceRule, string, error)) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(g.GetKey(lid, id)))
+		if err != nil {
+			return err
+		}
+		var old Goods
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		rule, note, err := f(&old)
+		if err != nil {
+			return err
+		}
+		err = addPriceHistory(txn, lid, PriceHistory{
+			GoodsID:    id,
+			SkuID:      rule.SkuID,
+			Price:      old.Price,
+			FinalPrice: rule.SalePrice,
+			Rule:       rule,
+			Note:       note,
+		})
+		if err != nil {
+			return err
+		}
+		old.UpdateTime = time.Now()
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+}
+
+func (g Goods) AddPriceRule(lid, id uint64, rule PriceRule) error {
+	return g.updatePriceRules(lid, id, func(old *Goods) (*PriceRule, string, error) {
+		if rule.SkuID != 0 {
+			if _, ok := old.GetSku(rule.SkuID); !ok {
+				return nil, "", badger.ErrKeyNotFound
+			}
+		}
+		old.PriceRules = append(old.PriceRules, rule)
+		return &rule, "添加活动", nil
+	})
+}
+
+func (g Goods) DeletePriceRule(lid, id, rid uint64) error {
+	return g.updatePriceRules(lid, id, func(old *Goods) (*PriceRule, string, error) {
+		for i, r := range old.PriceRules {
+			if r.ID == rid {
+				old.PriceRules = append(old.PriceRules[:i], old.PriceRules[i+1:]...)
+				return &r, "删除活动", nil
+			}
+		}
+		return nil, "", badger.ErrKeyNotFound
+	})
+}
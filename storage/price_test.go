@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 取消订单回退一次活动限量, 取消后不能重新打开, 限量不会被反复释放
+func TestPriceRuleLimitCancel(t *testing.T) {
+	initTestDB(t)
+	const lid = 100
+	now := time.Now()
+	goods := Goods{
+		ID:       1,
+		LesseeID: lid,
+		Status:   Active,
+		Name:     "清洗",
+		Price:    100,
+		Skus:     []Sku{{ID: 11, Values: []string{"小"}, Price: 100, Stock: 10}},
+		PriceRules: []PriceRule{{
+			ID:        21,
+			Name:      "秒杀",
+			SalePrice: 50,
+			Limit:     2,
+			StartTime: now.Add(-time.Hour),
+			EndTime:   now.Add(time.Hour),
+		}},
+	}
+	err := goods.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newOrder := func(id uint64, count int) *Order {
+		return &Order{
+			ID:       id,
+			LesseeID: lid,
+			Status:   Watting,
+			Goods:    []OrderGoods{{ID: 1, SkuID: 11, Count: count, RuleID: 21}},
+			User:     SimpleUser{ID: 3},
+		}
+	}
+	check := func(remain, stock int) {
+		t.Helper()
+		g, err := Model[Goods]().GetByID(lid, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rule, _ := g.getPriceRule(21)
+		sku, _ := g.GetSku(11)
+		if rule.Remain() != remain || sku.Stock != stock {
+			t.Fatalf("remain=%d stock=%d, want remain=%d stock=%d", rule.Remain(), sku.Stock, remain, stock)
+		}
+		if g.Sold != sku.Sold {
+			t.Fatalf("goods sold %d != sku sold %d", g.Sold, sku.Sold)
+		}
+	}
+
+	err = newOrder(1001, 2).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(0, 8)
+	err = newOrder(1002, 1).Save()
+	if !errors.Is(err, ErrPriceChanged) {
+		t.Fatalf("order over limit error = %v, want ErrPriceChanged", err)
+	}
+
+	_, err = Model[Order]().Update(lid, 1001, "", "", "", Canceled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(2, 10)
+
+	// 取消后重新打开或再次取消都不允许, 限量保持不变
+	for _, status := range []OrderStatus{Watting, Comfirm, Canceled} {
+		_, err = Model[Order]().Update(lid, 1001, "", "", "", status)
+		if !errors.Is(err, ErrOrderStatus) {
+			t.Fatalf("update cancelled order to %s error = %v, want ErrOrderStatus", status, err)
+		}
+	}
+	check(2, 10)
+
+	// 释放的限量可以再被下单, 之后仍然受限
+	err = newOrder(1003, 2).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(0, 8)
+	err = newOrder(1004, 1).Save()
+	if !errors.Is(err, ErrPriceChanged) {
+		t.Fatalf("order over limit error = %v, want ErrPriceChanged", err)
+	}
+}
+
+// 下单后规格被删除, 取消订单仍然回退商品销量和活动限量
+func TestCancelAfterSkuRemoved(t *testing.T) {
+	initTestDB(t)
+	const lid = 100
+	now := time.Now()
+	goods := Goods{
+		ID:       1,
+		LesseeID: lid,
+		Status:   Active,
+		Name:     "清洗",
+		Price:    100,
+		Skus:     []Sku{{ID: 11, Values: []string{"小"}, Price: 100, Stock: 10}, {ID: 12, Values: []string{"大"}, Price: 200, Stock: 10}},
+		PriceRules: []PriceRule{{
+			ID:        21,
+			Name:      "秒杀",
+			SalePrice: 50,
+			Limit:     2,
+			StartTime: now.Add(-time.Hour),
+			EndTime:   now.Add(time.Hour),
+		}},
+	}
+	err := goods.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := &Order{
+		ID:       1001,
+		LesseeID: lid,
+		Status:   Watting,
+		Goods:    []OrderGoods{{ID: 1, SkuID: 11, Count: 2, RuleID: 21}},
+		User:     SimpleUser{ID: 3},
+	}
+	err = order.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Model[Goods]().GetByID(lid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Skus = g.Skus[1:]
+	err = g.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Model[Order]().Update(lid, 1001, "", "", "", Canceled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = Model[Goods]().GetByID(lid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, _ := g.getPriceRule(21)
+	if g.Sold != 0 || rule.Remain() != 2 {
+		t.Fatalf("sold=%d remain=%d, want sold=0 remain=2", g.Sold, rule.Remain())
+	}
+}
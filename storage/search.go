@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"mall/search"
+	"strings"
+	"sync"
+)
+
+// 商品搜索索引, 每个租户一个, 启动时从库中重建
+var goodsIndex = struct {
+	sync.RWMutex
+	m map[uint64]*search.Index
+}{m: make(map[uint64]*search.Index)}
+
+func getGoodsIndex(lid uint64, create bool) *search.Index {
+	goodsIndex.RLock()
+	ix := goodsIndex.m[lid]
+	goodsIndex.RUnlock()
+	if ix != nil || !create {
+		return ix
+	}
+	goodsIndex.Lock()
+	defer goodsIndex.Unlock()
+	if ix = goodsIndex.m[lid]; ix == nil {
+		ix = search.New()
+		goodsIndex.m[lid] = ix
+	}
+	return ix
+}
+
+// indexGoods 名称权重最高, 其次标签, 描述最低
+func indexGoods(g *Goods) {
+	getGoodsIndex(g.LesseeID, true).Put(g.ID,
+		search.Field{Text: g.Name, Weight: 3},
+		search.Field{Text: strings.Join(g.Tags, " "), Weight: 2},
+		search.Field{Text: g.Description, Weight: 1},
+	)
+}
+
+func unindexGoods(lid, id uint64) {
+	if ix := getGoodsIndex(lid, false); ix != nil {
+		ix.Delete(id)
+	}
+}
+
+func buildGoodsIndex() error {
+	m, err := GetAllWithPrefix[Goods]("goods/")
+	if err != nil {
+		return err
+	}
+	for _, g := range m {
+		indexGoods(&g)
+	}
+	return nil
+}
+
+// Search 返回按相关度排序的商品 id 和得分
+func (Goods) Search(lid uint64, q string) []search.Result {
+	ix := getGoodsIndex(lid, false)
+	if ix == nil {
+		return nil
+	}
+	return ix.Search(q)
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ErrSessionInvalid = errors.New("session invalid")
+	// ErrRefreshReused 已经轮换过的 refresh token 再次使用, 视为泄露, 会话已撤销
+	ErrRefreshReused = errors.New("refresh token reused")
+)
+
+// Session 一次登录, 对应一个 refresh token; 每次刷新都会换新的 refresh token
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uint64    `json:"user_id"`
+	TokenHash  string    `json:"token_hash"` // 当前 refresh token 的 sha256
+	Version    int       `json:"version"`    // 创建时用户的 TokenVersion
+	CreateTime time.Time `json:"create_time"`
+	UpdateTime time.Time `json:"update_time"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// 按 refresh token 查找会话
+type sessionRef struct {
+	UserID    uint64 `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+func (Session) GetKey(uid uint64, id string) string {
+	if id == "" {
+		return fmt.Sprintf("session/user/%d/", uid)
+	}
+	return fmt.Sprintf("session/user/%d/%s", uid, id)
+}
+
+func (Session) getRefreshKey(hash string) string {
+	return fmt.Sprintf("session/refresh/%s", hash)
+}
+
+// 轮换掉的 refresh token, 保留到原有效期结束, 用于发现重复使用
+func (Session) getRotatedKey(hash string) string {
+	return fmt.Sprintf("session/rotated/%s", hash)
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setSession(txn *badger.Txn, s *Session) error {
+	ttl := time.Until(s.ExpireTime)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = txn.SetEntry(badger.NewEntry([]byte(s.GetKey(s.UserID, s.ID)), data).WithTTL(ttl))
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(sessionRef{UserID: s.UserID, SessionID: s.ID})
+	if err != nil {
+		return err
+	}
+	return txn.SetEntry(badger.NewEntry([]byte(s.getRefreshKey(s.TokenHash)), data).WithTTL(ttl))
+}
+
+func deleteSession(txn *badger.Txn, s *Session) error {
+	err := txn.Delete([]byte(s.GetKey(s.UserID, s.ID)))
+	if err != nil {
+		return err
+	}
+	return txn.Delete([]byte(s.getRefreshKey(s.TokenHash)))
+}
+
+// CreateSession 新建会话, 返回明文 refresh token, 库中只保存哈希
+func CreateSession(uid uint64, version int, ttl time.Duration) (Session, string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return Session{}, "", err
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return Session{}, "", err
+	}
+	var now = time.Now()
+	s := Session{
+		ID:         id,
+		UserID:     uid,
+		TokenHash:  hashToken(token),
+		Version:    version,
+		CreateTime: now,
+		UpdateTime: now,
+		ExpireTime: now.Add(ttl),
+	}
+	err = GetDB().Update(func(txn *badger.Txn) error {
+		return setSession(txn, &s)
+	})
+	return s, token, err
+}
+
+// RotateSession 用 refresh token 换新的 refresh token, 旧的立即失效
+func RotateSession(token string, ttl time.Duration) (Session, string, error) {
+	var m Session
+	hash := hashToken(token)
+
+	var ref sessionRef
+	err := Get(m.getRefreshKey(hash), &ref)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		err = Get(m.getRotatedKey(hash), &ref)
+		if err == nil {
+			// 旧 token 被重复使用, 撤销整个会话
+			if err := m.Delete(ref.UserID, ref.SessionID); err != nil {
+				return Session{}, "", err
+			}
+			return Session{}, "", ErrRefreshReused
+		}
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return Session{}, "", ErrSessionInvalid
+		}
+		return Session{}, "", err
+	}
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	next, err := randomToken(32)
+	if err != nil {
+		return Session{}, "", err
+	}
+	var s Session
+	err = GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(m.GetKey(ref.UserID, ref.SessionID)))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return ErrSessionInvalid
+		}
+		if err != nil {
+			return err
+		}
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &s)
+		})
+		if err != nil {
+			return err
+		}
+		if s.TokenHash != hash {
+			return ErrSessionInvalid
+		}
+		err = deleteSession(txn, &s)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(ref)
+		if err != nil {
+			return err
+		}
+		err = txn.SetEntry(badger.NewEntry([]byte(m.getRotatedKey(hash)), data).WithTTL(time.Until(s.ExpireTime)))
+		if err != nil {
+			return err
+		}
+
+		var now = time.Now()
+		s.TokenHash = hashToken(next)
+		s.UpdateTime = now
+		s.ExpireTime = now.Add(ttl)
+		return setSession(txn, &s)
+	})
+	if err != nil {
+		return Session{}, "", err
+	}
+	return s, next, nil
+}
+
+func (m Session) Get(uid uint64, id string) (Session, error) {
+	var s Session
+	err := Get(m.GetKey(uid, id), &s)
+	return s, err
+}
+
+func (m Session) GetByUser(uid uint64) ([]Session, error) {
+	mm, err := GetAllWithPrefix[Session](m.GetKey(uid, ""))
+	if err != nil {
+		return nil, err
+	}
+	var sessions = make([]Session, 0, len(mm))
+	for _, v := range mm {
+		sessions = append(sessions, v)
+	}
+	return sessions, nil
+}
+
+func (m Session) Delete(uid uint64, id string) error {
+	s, err := m.Get(uid, id)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		return deleteSession(txn, &s)
+	})
+}
+
+func (m Session) DeleteByUser(uid uint64) error {
+	sessions, err := m.GetByUser(uid)
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for i := range sessions {
+			if err := deleteSession(txn, &sessions[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getRevokedKey(jti string) string {
+	return fmt.Sprintf("session/revoked/%s", jti)
+}
+
+// RevokeToken 把 access token 加入撤销列表, 到期后自动删除
+func RevokeToken(jti string, exp time.Time) error {
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		return nil
+	}
+	return Set(getRevokedKey(jti), true, ttl)
+}
+
+func IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := Get(getRevokedKey(jti), &revoked)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return revoked, err
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultImageQuota 租户未单独设置配额时的图片存储上限
+const DefaultImageQuota int64 = 1 << 30
+
+var ErrImageQuota = errors.New("image quota exceeded")
+
+// ImageUsage 租户图片存储用量
+type ImageUsage struct {
+	Used  int64 `json:"used"`
+	Count int   `json:"count"`
+	Quota int64 `json:"quota"`
+}
+
+// GetImageUsageKey 租户上传过的图片, 值为图片大小; 相同内容重复上传只计一次
+func GetImageUsageKey(lid uint64, key string) string {
+	return fmt.Sprintf("imgusage/%d/%s", lid, key)
+}
+
+func (l *Lessee) GetImageQuota() int64 {
+	if l.ImageQuota > 0 {
+		return l.ImageQuota
+	}
+	return DefaultImageQuota
+}
+
+func getImageUsage(txn *badger.Txn, lid uint64) (ImageUsage, error) {
+	var usage ImageUsage
+	opts := badger.DefaultIteratorOptions
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	prefix := []byte(GetImageUsageKey(lid, ""))
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return usage, err
+		}
+		var size int64
+		err = json.Unmarshal(val, &size)
+		if err != nil {
+			return usage, err
+		}
+		usage.Used += size
+		usage.Count++
+	}
+	return usage, nil
+}
+
+func GetImageUsage(lessee Lessee) (ImageUsage, error) {
+	var usage ImageUsage
+	err := GetDB().View(func(txn *badger.Txn) error {
+		var err error
+		usage, err = getImageUsage(txn, lessee.ID)
+		return err
+	})
+	usage.Quota = lessee.GetImageQuota()
+	return usage, err
+}
+
+// AddImageUsage 记录租户上传的图片, 超出配额时返回 ErrImageQuota
+func AddImageUsage(lessee Lessee, key string, size int) error {
+	usageKey := []byte(GetImageUsageKey(lessee.ID, key))
+	return GetDB().Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(usageKey)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		usage, err := getImageUsage(txn, lessee.ID)
+		if err != nil {
+			return err
+		}
+		if usage.Used+int64(size) > lessee.GetImageQuota() {
+			return ErrImageQuota
+		}
+		data, err := json.Marshal(size)
+		if err != nil {
+			return err
+		}
+		return txn.Set(usageKey, data)
+	})
+}
+
+// IsLesseeImage 图片地址指向已保存的图片, 并且是租户 lid 上传的
+func IsLesseeImage(lid uint64, path string) (bool, error) {
+	hash, ok := ImageHashFromPath(path)
+	if !ok {
+		return false, nil
+	}
+	key := GetBlobKey(hash)
+	for _, k := range []string{GetImageMetaKey(key), GetImageUsageKey(lid, key)} {
+		var v json.RawMessage
+		err := Get(k, &v)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func DeleteImageUsage(lid uint64, key string) error {
+	return Delete(GetImageUsageKey(lid, key))
+}
+
+// deleteBlobUsage 图片被回收后从所有租户的用量中去掉
+func deleteBlobUsage(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	deleted := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		deleted[k] = true
+	}
+	var usageKeys [][]byte
+	err := GetDB().View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("imgusage/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			// imgusage/<lid>/<image key>
+			parts := strings.SplitN(string(key), "/", 3)
+			if len(parts) == 3 && deleted[parts[2]] {
+				usageKeys = append(usageKeys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return GetDB().Update(func(txn *badger.Txn) error {
+		for _, k := range usageKeys {
+			err := txn.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
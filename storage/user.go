@@ -19,13 +19,31 @@ const (
 )
 
 type User struct {
-	ID         uint64    `json:"id"`
-	OpenID     string    `json:"open_id"`
-	Kind       UserKind  `json:"kind"`
-	Avatar     string    `json:"avatar"`
-	Nickname   string    `json:"nickname"`
+	ID           uint64      `json:"id"`
+	OpenID       string      `json:"open_id"`
+	UnionID      string      `json:"union_id,omitempty"` // 开放平台 UnionID, 网页扫码登录时用于找到小程序用户
+	Kind         UserKind    `json:"kind"`               // 只区分平台管理员和普通用户, 由 SetAdmin 修改; 租户中的角色见 Member
+	Avatar       string      `json:"avatar"`
+	Nickname     string      `json:"nickname"`
+	TokenVersion int         `json:"token_version"` // 写入 access token, 增加后之前签发的 token 全部失效
+	Suspension   *Suspension `json:"suspension,omitempty"`
+	CreateTime   time.Time   `json:"create_time"`
+	UpdateTime   time.Time   `json:"update_time"`
+}
+
+// Suspension 平台停用账号, 停用期间所有登录后的接口都不可用
+type Suspension struct {
+	Reason     string    `json:"reason"`
+	CreatorID  uint64    `json:"creator_id"`
+	ExpireTime time.Time `json:"expire_time"` // 零值表示永久
 	CreateTime time.Time `json:"create_time"`
-	UpdateTime time.Time `json:"update_time"`
+}
+
+func (u User) IsSuspended(now time.Time) bool {
+	if u.Suspension == nil {
+		return false
+	}
+	return u.Suspension.ExpireTime.IsZero() || now.Before(u.Suspension.ExpireTime)
 }
 
 func (u *User) GetKey(id uint64) string {
@@ -37,6 +55,9 @@ func (u *User) GetKey(id uint64) string {
 func (u *User) GetOpenKey(openid string) string {
 	return fmt.Sprintf("user/open/%s", openid)
 }
+func (u *User) GetUnionKey(unionid string) string {
+	return fmt.Sprintf("user/union/%s", unionid)
+}
 
 func (u *User) Save() error {
 	key := u.GetKey(u.ID)
@@ -51,7 +72,17 @@ func (u *User) Save() error {
 		if err != nil {
 			return err
 		}
+		err = setImageRefs(txn, key, nil, []string{u.Avatar})
+		if err != nil {
+			return err
+		}
 		data, _ = json.Marshal(u.ID)
+		if u.UnionID != "" {
+			err = txn.Set([]byte(u.GetUnionKey(u.UnionID)), data)
+			if err != nil {
+				return err
+			}
+		}
 		return txn.Set([]byte(openKey), data)
 	})
 
@@ -71,6 +102,15 @@ func (u User) GetByOpenID(openid string) (User, error) {
 	return u.GetByID(id)
 }
 
+func (u User) GetByUnionID(unionid string) (User, error) {
+	var id uint64
+	err := Get(u.GetUnionKey(unionid), &id)
+	if err != nil {
+		return User{}, err
+	}
+	return u.GetByID(id)
+}
+
 func (u User) GetUsers() ([]User, error) {
 	prefix := u.GetKey(0)
 	m, err := GetAllWithPrefix[User](prefix)
@@ -118,13 +158,26 @@ func (u *User) Update(id uint64) error {
 		if u.Nickname != "" {
 			old.Nickname = u.Nickname
 		}
-		if u.Avatar != "" {
-			old.Avatar = u.Avatar
+		if u.UnionID != "" && u.UnionID != old.UnionID {
+			if old.UnionID != "" {
+				err = txn.Delete([]byte(u.GetUnionKey(old.UnionID)))
+				if err != nil {
+					return err
+				}
+			}
+			data, _ := json.Marshal(id)
+			err = txn.Set([]byte(u.GetUnionKey(u.UnionID)), data)
+			if err != nil {
+				return err
+			}
+			old.UnionID = u.UnionID
 		}
-		if u.Kind != "" && u.Kind != old.Kind {
-			if old.Kind != Admin {
-				old.Kind = u.Kind
+		if u.Avatar != "" {
+			err = setImageRefs(txn, string(item.KeyCopy(nil)), []string{old.Avatar}, []string{u.Avatar})
+			if err != nil {
+				return err
 			}
+			old.Avatar = u.Avatar
 		}
 		old.UpdateTime = time.Now()
 
@@ -142,10 +195,87 @@ func (u User) Delete(id uint64) error {
 		return err
 	}
 
-	return GetDB().Update(func(txn *badger.Txn) error {
+	err = GetDB().Update(func(txn *badger.Txn) error {
+		if err := setImageRefs(txn, u.GetKey(id), []string{user.Avatar}, nil); err != nil {
+			return err
+		}
 		if err := txn.Delete([]byte(u.GetKey(id))); err != nil {
 			return err
 		}
+		if user.UnionID != "" {
+			if err := txn.Delete([]byte(u.GetUnionKey(user.UnionID))); err != nil {
+				return err
+			}
+		}
 		return txn.Delete([]byte(u.GetOpenKey(user.OpenID)))
 	})
+	if err != nil {
+		return err
+	}
+	err = Model[Member]().DeleteByUser(id)
+	if err != nil {
+		return err
+	}
+	err = Model[Session]().DeleteByUser(id)
+	if err != nil {
+		return err
+	}
+	return DeleteAllWithPrefix(Model[Address]().GetKey(id, 0))
+}
+
+// Suspend 停用账号, s 为空时恢复
+func (u User) Suspend(id uint64, s *Suspension) error {
+	return GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(u.GetKey(id)))
+		if err != nil {
+			return err
+		}
+		var old User
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		old.Suspension = s
+		old.UpdateTime = time.Now()
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+}
+
+// RevokeTokens 撤销用户所有会话, 已签发的 access token 因版本不一致失效
+func (u User) RevokeTokens(id uint64) error {
+	err := GetDB().Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(u.GetKey(id)))
+		if err != nil {
+			return err
+		}
+		var old User
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &old)
+		if err != nil {
+			return err
+		}
+		old.TokenVersion++
+
+		data, err = json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		return txn.Set(item.KeyCopy(nil), data)
+	})
+	if err != nil {
+		return err
+	}
+	return Model[Session]().DeleteByUser(id)
 }